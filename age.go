@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+//
+// Secrets files encrypted with age (https://age-encryption.org), such as secrets.env.age or secrets.json.age,
+// are decrypted in memory, so the plaintext is never written to disk except by templates.  The identities
+// (private keys) come from:
+//
+//   --age-identity /path      an identity file, such as one made by age-keygen.  Can be passed multiple times
+//   $SOPS_AGE_KEY_FILE        an identity file
+//   $SOPS_AGE_KEY             the identities themselves
+//
+// The same identities decrypt SOPS files
+//
+
+var (
+	ageIdentities     []age.Identity
+	ageIdentitiesErr  error
+	ageIdentitiesOnce sync.Once
+)
+
+func loadAgeIdentities() ([]age.Identity, error) {
+	ageIdentitiesOnce.Do(func() {
+		files := append([]string{}, ageIdentityFlag...)
+		if file := os.Getenv("SOPS_AGE_KEY_FILE"); file != "" {
+			files = append(files, file)
+		}
+		for _, file := range files {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				ageIdentitiesErr = err
+				return
+			}
+			identities, err := age.ParseIdentities(bytes.NewReader(content))
+			if err != nil {
+				ageIdentitiesErr = fmt.Errorf("bad age identity file %s: %s", file, err)
+				return
+			}
+			ageIdentities = append(ageIdentities, identities...)
+		}
+		if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+			identities, err := age.ParseIdentities(strings.NewReader(key))
+			if err != nil {
+				ageIdentitiesErr = fmt.Errorf("bad $SOPS_AGE_KEY: %s", err)
+				return
+			}
+			ageIdentities = append(ageIdentities, identities...)
+		}
+		if len(ageIdentities) == 0 {
+			ageIdentitiesErr = fmt.Errorf("no age identities: use --age-identity, $SOPS_AGE_KEY_FILE or $SOPS_AGE_KEY")
+		}
+	})
+	return ageIdentities, ageIdentitiesErr
+}
+
+//
+// Decrypt age-encrypted content, which may be binary or ASCII armored
+//
+func ageDecrypt(content []byte) ([]byte, error) {
+	identities, err := loadAgeIdentities()
+	if err != nil {
+		return nil, err
+	}
+	var in io.Reader = bytes.NewReader(content)
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte(armor.Header)) {
+		in = armor.NewReader(bytes.NewReader(bytes.TrimSpace(content)))
+	}
+	r, err := age.Decrypt(in, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+//
+// secrets.env.age or secrets.json.age
+//
+type ageFileSecretsProvider struct {
+	path string
+}
+
+func (p ageFileSecretsProvider) Name() string {
+	return p.path
+}
+
+func (p ageFileSecretsProvider) Secrets() (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := ageDecrypt(content)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt: %s", err)
+	}
+	secrets, _, err := parseSecrets(strings.TrimSuffix(p.path, ".age"), plaintext)
+	return secrets, err
+}
+
+func (p ageFileSecretsProvider) Encrypted() bool {
+	return true
+}
@@ -15,12 +15,16 @@ type Commands struct {
 	run        []*exec.Cmd         // list of commands to run BEFORE the primar
 	start      []*exec.Cmd         // list of services to start
 	credential *syscall.Credential // credentials for primary command
+	scope      *secretsScope       // --secrets-scope for primary command
+	secretEnv  []string            // --secret-env options for primary command
 }
 
 //
 // Removes --start and --run commands options and arguments from os.Args
 // Removes --user <uid|username> options and applies the credentials to following
 //           start or run commands and primary command
+// Removes --secrets-scope <patterns> options and applies the scope to the same commands
+// Removes --secret-env <NAME[=SECRET]> options and applies them to the next command only
 // Returns array of removed run commands, and an array of removed start commands
 //
 func removeCommandsFromOsArgs() Commands {
@@ -30,6 +34,9 @@ func removeCommandsFromOsArgs() Commands {
 
 	var cmd *exec.Cmd
 	var cmd_user *user.User
+	var scopeNext bool
+	var secretEnvNext bool
+	var secretEnv []string
 
     if debugFlag {
         log.Printf("")
@@ -49,35 +56,54 @@ func removeCommandsFromOsArgs() Commands {
 				Stderr:      os.Stderr,
 				SysProcAttr: &syscall.SysProcAttr{Credential: commands.credential}}
 			commands.start = append(commands.start, cmd)
+			commandScopes[cmd] = commands.scope
+			commandSecretEnvs[cmd], secretEnv = secretEnv, nil
 
 		case ("--run" == arg_i || "-run" == arg_i) && cmd == nil:
 			cmd = &exec.Cmd{Stdout: os.Stdout,
 				Stderr:      os.Stderr,
 				SysProcAttr: &syscall.SysProcAttr{Credential: commands.credential}}
 			commands.run = append(commands.run, cmd)
+			commandScopes[cmd] = commands.scope
+			commandSecretEnvs[cmd], secretEnv = secretEnv, nil
 
 		case ("--user" == arg_i || "-user" == arg_i) && cmd == nil:
-			if os.Getuid() != 0 {
+			if os.Getuid() != 0 && !dryRunFlag {
 				log.Fatalf("dockerfy must run as root to use the --user flag")
 			}
 			cmd_user = &user.User{}
 
+		case ("--secrets-scope" == arg_i || "-secrets-scope" == arg_i) && cmd == nil:
+			scopeNext = true
+
+		case ("--secret-env" == arg_i || "-secret-env" == arg_i) && cmd == nil:
+			secretEnvNext = true
+
 		case "--" == arg_i && cmd != nil: // End of args for this cmd
 			cmd = nil
 
 		default:
-			if cmd_user != nil {
+			if scopeNext {
+				scope, err := parseSecretsScope(arg_i)
+				if err != nil {
+					log.Fatalf("bad --secrets-scope: %s", err)
+				}
+				commands.scope = scope
+				scopeNext = false
+			} else if secretEnvNext {
+				if err := checkSecretEnv(arg_i); err != nil {
+					log.Fatalf("bad --secret-env: %s", err)
+				}
+				secretEnv = append(secretEnv, arg_i)
+				secretEnvNext = false
+			} else if cmd_user != nil {
 				// Expect a username or uid
 				var err1 error
 
 				user_name_or_id := arg_i
-				cmd_user, err1 = user.LookupId(user_name_or_id)
-				if cmd_user == nil {
-					// Not a userid, try as a username
-					cmd_user, err1 = user.Lookup(user_name_or_id)
-					if cmd_user == nil {
-						log.Fatalf("unknown user: '%s': %s", user_name_or_id, err1)
-					}
+				cmd_user, err1 = lookupUser(user_name_or_id)
+				if err1 != nil {
+					log.Fatalf("unknown user: '%s': %s", user_name_or_id, err1)
 				}
 				uid, _ := strconv.Atoi(cmd_user.Uid)
 				gid, _ := strconv.Atoi(cmd_user.Gid)
@@ -105,6 +131,13 @@ func removeCommandsFromOsArgs() Commands {
 	if cmd_user != nil {
 		log.Fatalln("need a username or uid after the --user flag")
 	}
+	if scopeNext {
+		log.Fatalln("need a list of secret name patterns after the --secrets-scope flag")
+	}
+	if secretEnvNext {
+		log.Fatalln("need NAME or NAME=SECRET after the --secret-env flag")
+	}
+	commands.secretEnv = secretEnv
 	if cmd != nil {
 		log.Fatalf("need a command after the --start or --run flag")
 	}
@@ -122,6 +155,16 @@ func removeCommandsFromOsArgs() Commands {
 	return commands
 }
 
+//
+// Look up a user account by uid, or by username if it is not a uid
+//
+func lookupUser(user_name_or_id string) (*user.User, error) {
+	if u, err := user.LookupId(user_name_or_id); err == nil {
+		return u, nil
+	}
+	return user.Lookup(user_name_or_id)
+}
+
 func toString(cmd *exec.Cmd) string {
 	s := ""
 	for _, arg := range cmd.Args {
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+//
+// Cgroup-aware resource template functions, so worker counts and heap sizes can match the
+// container's actual limits instead of the host's.  e.g.
+//
+//   worker_processes {{ cpuQuota }};
+//   -Xmx{{ memoryLimitMB }}m
+//
+// Limits are read from cgroup v2 (unified) or v1 control files, falling back to the host's values
+// when the container is not limited.  --cgroup-root points them at another cgroup filesystem
+//
+
+var (
+	procSelfCgroup = "/proc/self/cgroup"
+	procMeminfo    = "/proc/meminfo"
+	procPidMax     = "/proc/sys/kernel/pid_max"
+)
+
+func cgroupV2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRootFlag, "cgroup.controllers"))
+	return err == nil
+}
+
+//
+// The cgroup path of this process for a v1 controller, or for the unified hierarchy if controller is ""
+//
+func cgroupPath(controller string) string {
+	cgroups, err := os.Open(procSelfCgroup)
+	if err != nil {
+		return "/"
+	}
+	defer cgroups.Close()
+
+	scanner := bufio.NewScanner(cgroups)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, c := range strings.Split(fields[1], ",") {
+			if c == controller {
+				return fields[2]
+			}
+		}
+	}
+	return "/"
+}
+
+//
+// Read a cgroup control file, trying this process's own cgroup first, then the root of the
+// hierarchy, which is what a container with its own cgroup namespace sees.  Returns "" if not found
+//
+func readCgroupFile(controller, name string) string {
+	dir := cgroupRootFlag
+	if !cgroupV2() {
+		dir = filepath.Join(cgroupRootFlag, controller)
+	} else {
+		controller = ""
+	}
+	for _, path := range []string{
+		filepath.Join(dir, cgroupPath(controller), name),
+		filepath.Join(dir, name),
+	} {
+		if content, err := ioutil.ReadFile(path); err == nil {
+			return strings.TrimSpace(string(content))
+		}
+	}
+	return ""
+}
+
+func hostMemory() (int, error) {
+	meminfo, err := os.Open(procMeminfo)
+	if err != nil {
+		return 0, err
+	}
+	defer meminfo.Close()
+
+	scanner := bufio.NewScanner(meminfo)
+	for scanner.Scan() {
+		// MemTotal:       16318480 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 0, fmt.Errorf("bad MemTotal '%s' in %s", fields[1], procMeminfo)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("no MemTotal in %s", procMeminfo)
+}
+
+//
+// The number of CPUs this container may use, rounded up: a quota of 1.5 CPUs returns 2
+//
+func cpuQuota() (int, error) {
+	var quota, period string
+	if cgroupV2() {
+		// "max 100000" or "150000 100000"
+		fields := strings.Fields(readCgroupFile("cpu", "cpu.max"))
+		if len(fields) == 2 {
+			quota, period = fields[0], fields[1]
+		}
+	} else {
+		quota = readCgroupFile("cpu", "cpu.cfs_quota_us")
+		period = readCgroupFile("cpu", "cpu.cfs_period_us")
+	}
+
+	cpus := runtime.NumCPU()
+	if quota == "" || quota == "max" || quota == "-1" {
+		return cpus, nil
+	}
+	q, err := strconv.Atoi(quota)
+	if err != nil {
+		return 0, fmt.Errorf("cpuQuota: bad cpu quota '%s'", quota)
+	}
+	p, err := strconv.Atoi(period)
+	if err != nil || p <= 0 {
+		return 0, fmt.Errorf("cpuQuota: bad cpu period '%s'", period)
+	}
+	if limit := (q + p - 1) / p; limit < cpus {
+		cpus = limit
+	}
+	if cpus < 1 {
+		cpus = 1
+	}
+	return cpus, nil
+}
+
+//
+// The memory limit of this container in bytes, or the host's total memory if it is not limited
+//
+func memoryLimit() (int, error) {
+	var limit string
+	if cgroupV2() {
+		limit = readCgroupFile("memory", "memory.max")
+	} else {
+		limit = readCgroupFile("memory", "memory.limit_in_bytes")
+	}
+
+	host, err := hostMemory()
+	if err != nil {
+		return 0, fmt.Errorf("memoryLimit: %s", err)
+	}
+	if limit == "" || limit == "max" {
+		return host, nil
+	}
+	bytes, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("memoryLimit: bad memory limit '%s'", limit)
+	}
+	// cgroup v1 reports "unlimited" as a huge number
+	if bytes > int64(host) {
+		return host, nil
+	}
+	return int(bytes), nil
+}
+
+func memoryLimitMB() (int, error) {
+	bytes, err := memoryLimit()
+	return bytes / (1024 * 1024), err
+}
+
+//
+// The maximum number of processes this container may run, or the host's pid_max if it is not limited
+//
+func pidsLimit() (int, error) {
+	limit := readCgroupFile("pids", "pids.max")
+	if limit == "" || limit == "max" {
+		content, err := ioutil.ReadFile(procPidMax)
+		if err != nil {
+			return 0, fmt.Errorf("pidsLimit: %s", err)
+		}
+		limit = strings.TrimSpace(string(content))
+	}
+	pids, err := strconv.Atoi(limit)
+	if err != nil {
+		return 0, fmt.Errorf("pidsLimit: bad pids limit '%s'", limit)
+	}
+	return pids, nil
+}
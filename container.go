@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//
+// Is dockerfy running in a container.  Only Docker creates /.dockerenv, so also look for Podman's
+// /run/.containerenv, the $container variable set by Podman and systemd-nspawn, the variables
+// Kubernetes gives every pod, and container runtimes in /proc/self/cgroup
+//
+
+var containerCgroupMarkers = []string{"docker", "kubepods", "containerd", "libpod", "crio", "lxc"}
+
+func inContainer() bool {
+	for _, path := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	if os.Getenv("container") != "" || os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return true
+	}
+	cgroups, err := ioutil.ReadFile(procSelfCgroup)
+	if err != nil {
+		return false
+	}
+	for _, marker := range containerCgroupMarkers {
+		if strings.Contains(string(cgroups), marker) {
+			return true
+		}
+	}
+	return false
+}
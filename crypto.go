@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//
+// Cryptography and encoding template functions, so secrets can be transformed into the exact
+// representation a config file requires without ever landing in the environment.  e.g.
+//
+//   proxy_set_header Authorization "Basic {{ concat .Secret.PROXY_USER ":" .Secret.PROXY_PASSWORD | b64enc }}";
+//
+
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func b64dec(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("b64dec: %s", err)
+	}
+	return string(data), nil
+}
+
+func sha256sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha1sum(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+//
+// hex encoded HMAC-SHA256 of message: `{{ hmac .Secret.SIGNING_KEY "message" }}`
+//
+func hmacSha256(key, message string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func bcryptHash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("bcrypt: %s", err)
+	}
+	return string(hash), nil
+}
+
+//
+// an htpasswd line for user with a bcrypt hashed password, the same as `htpasswd -nbB user password`
+//
+func htpasswd(user, password string) (string, error) {
+	if strings.Contains(user, ":") {
+		return "", fmt.Errorf("htpasswd: user name '%s' must not contain ':'", user)
+	}
+	hash, err := bcryptHash(password)
+	if err != nil {
+		return "", err
+	}
+	// Apache writes the equivalent $2y$ prefix, which is the one every htpasswd reader accepts
+	return user + ":$2y$" + strings.TrimPrefix(hash, "$2a$"), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+//
+// Load a YAML, JSON or TOML document, chosen by the file extension
+//
+func loadDataFile(fileName string) (interface{}, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(fileName) {
+	case ".yaml", ".yml":
+		return fromYaml(string(content))
+	case ".json":
+		return fromJson(string(content))
+	case ".toml":
+		return fromToml(string(content))
+	}
+	return nil, fmt.Errorf("unknown file extension, must end with .yaml, .yml, .json or .toml")
+}
+
+//
+// Merge src over dest.  Maps are merged key by key, all other values from src replace those in dest
+//
+func deepMerge(dest, src interface{}) interface{} {
+	destMap, ok := dest.(map[string]interface{})
+	if !ok {
+		return src
+	}
+	srcMap, ok := src.(map[string]interface{})
+	if !ok {
+		return src
+	}
+	for key, value := range srcMap {
+		destMap[key] = deepMerge(destMap[key], value)
+	}
+	return destMap
+}
+
+//
+// return the documents loaded by the --data name=/path options, keyed by name
+//
+// --data may be passed multiple times with the same name, in which case the later files
+// are deep-merged over the earlier ones.  Works for {{ .Env.VAR }} in file names, but not {{ .Data.NAME }}
+//
+func getData() map[string]interface{} {
+	data := make(map[string]interface{})
+
+	for i, d := range dataFlag {
+		parts := strings.SplitN(d, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("bad data argument: '%s'. expected \"name=/path/to/file\"", d)
+		}
+		name, fileName := parts[0], file_name_template_eval(flagSource("data", i), parts[1])
+		exitOnTemplateErrors()
+
+		if verboseFlag {
+			log.Printf("Loading data %s from: %s", name, fileName)
+		}
+		doc, err := loadDataFile(fileName)
+		if err != nil {
+			log.Fatalf("Error loading data file '%s':%s", fileName, err)
+		}
+		data[name] = deepMerge(data[name], doc)
+	}
+	return data
+}
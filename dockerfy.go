@@ -38,17 +38,31 @@ var (
 
 // Flags
 var (
+	ageIdentityFlag      sliceVar
+	cgroupRootFlag       string
+	dataFlag             sliceVar
 	delimsFlag           string
+	dryRunFlag           bool
+	envFilesFlag         sliceVar
 	overlaysFlag         sliceVar
 	logPollFlag          bool
 	reapPollIntervalFlag time.Duration
 	reapFlag             bool
+	readRootsFlag        sliceVar
+	redactSecretsFlag    bool
 	runsFlag             sliceVar
 	secretsFilesFlag     sliceVar
+	secretsFlag          sliceVar
+	secretFilesFlag      sliceVar
+	secretsDirsFlag      sliceVar
+	secretsDestFlag      string
+	secretsSeparatorFlag string
+	secretsTrimFlag      bool
 	startsFlag           sliceVar
 	stderrTailFlag       sliceVar
 	stdoutTailFlag       sliceVar
 	templatesFlag        sliceVar
+	templatesInlineFlag  sliceVar
 	usersFlag            sliceVar
     verboseFlag          bool
     debugFlag            bool
@@ -110,6 +124,11 @@ Arguments:
              --wait tcp://web:8000 nginx \
              --secrets-files /secrets/secrets.env
 	`)
+	println(`   Show what the above would do, without changing anything, using the environment from ci.env:
+
+       dockerfy render --env-file ci.env --template nginx.tmpl:/etc/nginx/nginx.conf \
+             --secrets-files /secrets/secrets.env -- nginx
+	`)
 	println(`   Run a command and reap any zombie children that the command forgets to reap
 
        dockerfy --reap command
@@ -124,6 +143,12 @@ Arguments:
        dockerfy --user nginx /usr/bin/id
 	     `)
 
+	println(`   Let only the migration see the DB_ADMIN_ secrets, and the main command all the others
+
+       dockerfy --secrets-files /secrets/secrets.env --secrets-scope 'DB_ADMIN_*' --run migrate -- \
+             --secrets-scope '!DB_ADMIN_*' app
+	     `)
+
 	println(`   Start /bin/service before the main command runs and exit if the service fails:
 
        dockerfy --start /bin/sleep 5 -- /bin/service
@@ -146,9 +171,22 @@ func main() {
 	flag.BoolVar(&versionFlag, "version", false, "show version")
 	flag.BoolVar(&helpFlag, "help", false, "print help message")
 	flag.BoolVar(&logPollFlag, "log-poll", false, "use polling to tail log files")
-	flag.Var(&templatesFlag, "template", "Template (/template:/dest). Can be passed multiple times")
+	flag.BoolVar(&dryRunFlag, "dry-run", false, "print rendered templates, diffs and commands without changing anything. Same as `dockerfy render`")
+	flag.Var(&envFilesFlag, "env-file", "load environment variables from a NAME=VALUE file before evaluating templates. Can be passed multiple times")
+	flag.Var(&templatesFlag, "template", "Template (/template:/dest[:mode=0644,owner=user,group=group,mkdirs,no-overwrite]). Can be passed multiple times")
+	flag.Var(&templatesInlineFlag, "template-inline", "Inline template (content:/dest[:opts]) with the same options as --template. Can be passed multiple times")
 	flag.Var(&overlaysFlag, "overlay", "overlay (/src:/dest). Can be passed multiple times")
+	flag.Var(&dataFlag, "data", "data file (name=/path/file.yaml) available to templates as .Data.name. Can be passed multiple times")
+	flag.Var(&readRootsFlag, "read-root", "directory whose files templates may read with readFile, glob, listDir and fileMode. Can be passed multiple times")
 	flag.Var(&secretsFilesFlag, "secrets-files", "secrets files (path to secrets.env files). Colon-separated list")
+	flag.Var(&ageIdentityFlag, "age-identity", "age identity file for decrypting .age and SOPS secrets files. Can be passed multiple times")
+	flag.Var(&secretsDirsFlag, "secrets-dir", "directory of secrets files named by the secret, such as /run/secrets. Watched, and templates rendered again, when it changes. Can be passed multiple times")
+	flag.BoolVar(&secretsTrimFlag, "secrets-trim-newline", true, "trim one trailing newline from each --secrets-dir secret")
+	flag.StringVar(&secretsSeparatorFlag, "secrets-separator", ".", "separator for the names of nested secrets, such as db.password or DB__PASSWORD")
+	flag.StringVar(&secretsDestFlag, "secrets-dest", "", "directory for each user's copies of the secrets files, \"home\" for ~/.secrets, or \"none\". Defaults to a tmpfs")
+	flag.Var(&secretsFlag, "secrets", "secrets source: a .env or .json file, or vault://mount/path?opts. Can be passed multiple times")
+	flag.BoolVar(&redactSecretsFlag, "redact-secrets", false, "replace secret values with *** in the output of commands, tailed files and dockerfy's log")
+	flag.Var(&secretFilesFlag, "secret-file", "write one secret to a file (KEY[:/path[:mode[:owner]]]), removed on exit. Can be passed multiple times")
 	flag.Var(&runsFlag, "run", "run (cmd [opts] [args] --) Can be passed multiple times")
 	flag.Var(&startsFlag, "start", "start (cmd [opts] [args] --) Can be passed multiple times")
 	flag.BoolVar(&reapFlag, "reap", false, "reap all zombie processes")
@@ -159,16 +197,29 @@ func main() {
 	flag.StringVar(&delimsFlag, "delims", "", `template tag delimiters. default "{{":"}}" `)
 	flag.Var(&waitFlag, "wait", "Host (tcp/tcp4/tcp6/http/https) to wait for before this container starts. Can be passed multiple times. e.g. tcp://db:5432")
 	flag.DurationVar(&waitTimeoutFlag, "timeout", 10*time.Second, "Host wait timeout duration, defaults to 10s")
+	flag.StringVar(&cgroupRootFlag, "cgroup-root", "/sys/fs/cgroup", "cgroup filesystem read by the cpuQuota, memoryLimit and pidsLimit template functions")
 	flag.DurationVar(&reapPollIntervalFlag, "reap-poll-interval", 120*time.Second, "Polling interval for reaping zombies")
 
-    // Manually pre-process the --debug and --verbose flags so we can debug our complex argument pre-processing
-    // that happens BEFORE flag.Parse()
+    // `dockerfy render ...` is the same as `dockerfy --dry-run ...`
+    if len(os.Args) > 1 && strings.TrimSpace(os.Args[1]) == "render" {
+        os.Args[1] = "--dry-run"
+    }
+
+    // Manually pre-process the --debug, --verbose and --dry-run flags so we can debug our complex argument
+    // pre-processing that happens BEFORE flag.Parse().  --dry-run only counts before the first command, so
+    // a command's own --dry-run option is passed to it
+    inCommands := false
     for i := 0; i < len(os.Args); i++ {
-        if strings.TrimSpace(os.Args[i]) == "--debug" {
+        arg := strings.TrimSpace(os.Args[i])
+        if arg == "--debug" {
             debugFlag = true
             log.Printf("debugging output ..")
-        } else if strings.TrimSpace(os.Args[i]) == "--verbose" {
+        } else if arg == "--verbose" {
             verboseFlag = true
+        } else if arg == "--dry-run" && !inCommands {
+            dryRunFlag = true
+        } else if arg == "--" || arg == "--run" || arg == "-run" || arg == "--start" || arg == "-start" {
+            inCommands = true
         }
     }
 
@@ -176,6 +227,8 @@ func main() {
 
 	flag.Usage = usage
 
+	// flag.Parse has the final say, since it stops at the primary command
+	dryRunFlag = false
 	flag.Parse()
 
 	if helpFlag {
@@ -193,6 +246,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	for _, envFile := range envFilesFlag {
+		if err := loadEnvFile(envFile); err != nil {
+			log.Fatalf("Error loading env file '%s':%s", envFile, err)
+		}
+	}
+	reloadTemplateContext()
+
+	if redactSecretsFlag {
+		// load the secrets now, so they are redacted from everything that follows
+		currentTemplateContext().secretsMap()
+		log.SetOutput(redactLogWriter{os.Stderr})
+	}
+
 	if delimsFlag != "" {
 		delims = strings.Split(delimsFlag, ":")
 		if len(delims) != 2 {
@@ -200,8 +266,14 @@ func main() {
 		}
 	}
 
+	checkTemplateArguments(commands, flag.Args())
+	exitOnTemplateErrors()
+
+	parseSecretFiles()
+	exitOnTemplateErrors()
+
 	// Overlay files from src --> dst
-	for _, o := range overlaysFlag {
+	for i, o := range overlaysFlag {
         if debugFlag {
             log.Printf("--overlay: %s", o)
         }
@@ -210,7 +282,10 @@ func main() {
 			if len(parts) != 2 {
 				log.Fatalf("bad overlay argument: '%s'. expected \"/src:/dest\"", o)
 			}
-			src, dest := string_template_eval(parts[0]), string_template_eval(parts[1])
+			src, dest := string_template_eval(flagSource("overlay", i), parts[0]), string_template_eval(flagSource("overlay", i), parts[1])
+			if hasTemplateErrors() {
+				continue
+			}
 			if _, err := os.Stat(src); os.IsNotExist(err) {
 				log.Printf("overlay source: %s does not exist.  Skipping", src)
 				continue
@@ -227,6 +302,10 @@ func main() {
 
 			if matches, err := filepath.Glob(src); err == nil {
 				for _, dir := range matches {
+					if dryRunFlag {
+						dryRunOverlay(dir, dest)
+						continue
+					}
 					cp_opts := "-r"
 					if verboseFlag {
 						cp_opts = "-rv"
@@ -243,20 +322,36 @@ func main() {
 		}
 	}
 
-	for _, t := range templatesFlag {
-		template, dest := t, ""
-		if strings.Contains(t, ":") {
-			parts := strings.Split(t, ":")
-			if len(parts) != 2 {
-				log.Fatalf("bad template argument: %s. expected \"/template:/dest\"", t)
-			}
-			template, dest = string_template_eval(parts[0]), string_template_eval(parts[1])
-		}
-		generateFile(template, dest)
+	exitOnTemplateErrors()
+
+	if err := generateTemplates(); err != nil {
+		log.Fatal(err)
+	}
+	exitOnTemplateErrors()
+
+	// The primary command is registered with its scope and secret env before any command starts, since
+	// the goroutines that run commands read commandScopes and commandSecretEnvs
+	var primary_command *exec.Cmd
+	if flag.NArg() > 0 {
+		primary_command = exec.Command(flag.Arg(0), flag.Args()[1:]...)
+		primary_command.SysProcAttr = &syscall.SysProcAttr{Credential: commands.credential}
+		commandScopes[primary_command] = commands.scope
+		commandSecretEnvs[primary_command] = commands.secretEnv
+	}
+
+	if dryRunFlag {
+		dryRunWaits()
+		writeSecretFiles()
+		dryRunCommands(commands, primary_command)
+		reportTemplateErrors()
+		os.Exit(exitCode)
 	}
 
 	waitForDependencies()
 
+	// after the waits, so a timeout does not leave them behind
+	writeSecretFiles()
+
 	// Setup context
 	ctx, cancel = context.WithCancel(context.Background())
 
@@ -277,18 +372,33 @@ func main() {
 		wg.Wait()
         if exitCode != 0 {
             cancel()
-            os.Exit(exitCode)
+            exitAndCleanUp(exitCode)
         }
 	}
 
-	for _, logFile := range stdoutTailFlag {
+	stdoutFiles := make([]string, len(stdoutTailFlag))
+	for i, logFile := range stdoutTailFlag {
+		stdoutFiles[i] = string_template_eval(flagSource("stdout", i), logFile)
+	}
+	stderrFiles := make([]string, len(stderrTailFlag))
+	for i, logFile := range stderrTailFlag {
+		stderrFiles[i] = string_template_eval(flagSource("stderr", i), logFile)
+	}
+	exitOnTemplateErrors()
+
+	for _, logFile := range stdoutFiles {
 		wg.Add(1)
-		go tailFile(ctx, cancel, string_template_eval(logFile), logPollFlag, os.Stdout)
+		go tailFile(ctx, cancel, logFile, logPollFlag, os.Stdout)
 	}
 
-	for _, logFile := range stderrTailFlag {
+	for _, logFile := range stderrFiles {
 		wg.Add(1)
-		go tailFile(ctx, cancel, string_template_eval(logFile), logPollFlag, os.Stderr)
+		go tailFile(ctx, cancel, logFile, logPollFlag, os.Stderr)
+	}
+
+	if len(secretsDirsFlag) > 0 {
+		wg.Add(1)
+		go watchSecretsDirs(ctx)
 	}
 
 	// Start the reaper
@@ -313,7 +423,7 @@ func main() {
 		}, cmd, true /*cancel_when_finished*/)
 	}
 
-	if flag.NArg() > 0 {
+	if primary_command != nil {
 
 		// perform template substitution on primary cmd
 		//for i, arg := range flag.Args() {
@@ -326,8 +436,6 @@ func main() {
 		}
 		wg.Add(1)
 
-		primary_command := exec.Command(flag.Arg(0), flag.Args()[1:]...)
-		primary_command.SysProcAttr = &syscall.SysProcAttr{Credential: commands.credential}
 		go runCmd(ctx, func() {
 			if verboseFlag {
 				log.Printf("Primary Command `%s` finished\n", cmdString)
@@ -342,5 +450,5 @@ func main() {
 
 	wg.Wait()
 
-	os.Exit(exitCode)
+	exitAndCleanUp(exitCode)
 }
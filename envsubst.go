@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+//
+// A simple envsubst-style template engine, for files that only need variable substitution and would
+// otherwise collide with {{ }} in Jinja, Handlebars or Helm content.  It understands:
+//
+//   ${VAR}             the environment variable VAR, which must be set
+//   ${VAR:-default}    VAR, or default if VAR is unset or empty
+//   ${Env.VAR}         the same as ${VAR}
+//   ${Secret.NAME}     the secret NAME
+//   $$                 a literal $
+//
+// Anything else, such as nginx's $host, is left alone.  Errors are reported like text/template's, so they
+// show the line and column of the offending variable
+//
+func renderEnvsubst(context *TemplateContext, source, content string) ([]byte, error) {
+	var result bytes.Buffer
+	line, lineStart := 1, 0
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		if c == '\n' {
+			line, lineStart = line+1, i+1
+		}
+		if c != '$' || i+1 == len(content) {
+			result.WriteByte(c)
+			continue
+		}
+		switch content[i+1] {
+		case '$':
+			result.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexAny(content[i+2:], "}\n")
+			if end < 0 || content[i+2+end] != '}' {
+				return nil, fmt.Errorf("template: %s:%d:%d: unclosed ${", source, line, i-lineStart)
+			}
+			value, err := envsubstValue(context, content[i+2:i+2+end])
+			if err != nil {
+				return nil, fmt.Errorf("template: %s:%d:%d: %s", source, line, i-lineStart, err)
+			}
+			result.WriteString(value)
+			i += 2 + end
+		default:
+			result.WriteByte(c)
+		}
+	}
+	return result.Bytes(), nil
+}
+
+//
+// The value of the expression inside ${...}
+//
+func envsubstValue(context *TemplateContext, expr string) (string, error) {
+	name, defaultValue, hasDefault := expr, "", false
+	if sep := strings.Index(expr, ":-"); sep >= 0 {
+		name, defaultValue, hasDefault = expr[:sep], expr[sep+2:], true
+	}
+
+	vars := context.Env()
+	switch {
+	case strings.HasPrefix(name, "Secret."):
+		secrets, err := context.Secret()
+		if err != nil {
+			return "", err
+		}
+		vars, name = secrets, strings.TrimPrefix(name, "Secret.")
+	case strings.HasPrefix(name, "Env."):
+		name = strings.TrimPrefix(name, "Env.")
+	}
+	if name == "" {
+		return "", fmt.Errorf("empty variable name in ${%s}", expr)
+	}
+
+	value, ok := vars[name]
+	if hasDefault && value == "" {
+		return defaultValue, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("${%s} is not set", expr)
+	}
+	return value, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Exit code for template errors, so they can be told apart from the exit codes of commands.
+// EX_CONFIG from sysexits.h
+const templateErrorExitCode = 78
+
+//
+// A template error, with enough context to show where it happened
+//
+type templateError struct {
+	source string // --wait[2], a template file path, etc.
+	text   string // the template itself
+	err    error
+}
+
+var (
+	templateErrors      []*templateError
+	templateErrorsMutex sync.Mutex
+)
+
+// template: NAME:LINE[:COLUMN]: message
+var templateErrorPosition = regexp.MustCompile(`^(\d+)(?::(\d+))?: (.*)$`)
+
+// function "bogus" not defined
+var templateErrorQuoted = regexp.MustCompile(`"([^"]+)"`)
+
+func (e *templateError) Error() string {
+	message := e.err.Error()
+	message = strings.TrimPrefix(message, "template: "+e.source+":")
+	m := templateErrorPosition.FindStringSubmatch(message)
+	if m == nil {
+		return fmt.Sprintf("template error in %s: %s", e.source, message)
+	}
+	message = strings.Replace(m[3], `executing "`+e.source+`" `, "", 1)
+	lineNum, _ := strconv.Atoi(m[1])
+	lines := strings.Split(e.text, "\n")
+	if lineNum < 1 || lineNum > len(lines) {
+		return fmt.Sprintf("template error in %s line %d: %s", e.source, lineNum, message)
+	}
+	line := lines[lineNum-1]
+
+	// execution errors know the column; for parse errors, point at what the message quotes,
+	// or else at the first action on the line
+	column := -1
+	if m[2] != "" {
+		column, _ = strconv.Atoi(m[2])
+	} else if q := templateErrorQuoted.FindStringSubmatch(message); q != nil {
+		column = strings.Index(line, q[1])
+	}
+	if column < 0 || column > len(line) {
+		column = strings.Index(line, leftDelim())
+	}
+	if column < 0 {
+		column = strings.Index(line, "{{")
+	}
+	if column < 0 {
+		column = 0
+	}
+
+	// keep the caret aligned under tabs
+	pad := []rune{}
+	for _, r := range line[:column] {
+		if r == '\t' {
+			pad = append(pad, '\t')
+		} else {
+			pad = append(pad, ' ')
+		}
+	}
+	return fmt.Sprintf("template error in %s line %d: %s\n    %s\n    %s^", e.source, lineNum, message, line, string(pad))
+}
+
+func leftDelim() string {
+	if len(delims) > 0 {
+		return delims[0]
+	}
+	return "{{"
+}
+
+//
+// Remember a template error, so all of them can be reported together.  A --dry-run evaluates templates
+// that already failed the syntax check, so the same error is only remembered once
+//
+func addTemplateError(source, text string, err error) {
+	templateErrorsMutex.Lock()
+	defer templateErrorsMutex.Unlock()
+	for _, e := range templateErrors {
+		if e.source == source && e.text == text && e.err.Error() == err.Error() {
+			return
+		}
+	}
+	templateErrors = append(templateErrors, &templateError{source: source, text: text, err: err})
+}
+
+func hasTemplateErrors() bool {
+	templateErrorsMutex.Lock()
+	defer templateErrorsMutex.Unlock()
+	return len(templateErrors) > 0
+}
+
+//
+// Report all the template errors so far and exit with templateErrorExitCode
+//
+func reportTemplateErrors() {
+	templateErrorsMutex.Lock()
+	defer templateErrorsMutex.Unlock()
+	if len(templateErrors) == 0 {
+		return
+	}
+	for _, e := range templateErrors {
+		log.Println(e)
+	}
+	log.Printf("%d template error(s)", len(templateErrors))
+	exitAndCleanUp(templateErrorExitCode)
+}
+
+//
+// Log and forget the template errors so far, once the commands are running and dockerfy must not exit
+//
+func logTemplateErrors() bool {
+	templateErrorsMutex.Lock()
+	defer templateErrorsMutex.Unlock()
+	for _, e := range templateErrors {
+		log.Println(e)
+	}
+	hadErrors := len(templateErrors) > 0
+	templateErrors = nil
+	return hadErrors
+}
+
+//
+// Exit if there were template errors, unless this is a --dry-run, which reports them all at the end
+//
+func exitOnTemplateErrors() {
+	if !dryRunFlag {
+		reportTemplateErrors()
+	}
+}
+
+//
+// Parse (without executing) a template string, so syntax errors in every argument
+// are found before dockerfy does anything
+//
+func checkTemplate(source, text string) {
+	if _, err := newStringTemplate(source).Parse(text); err != nil {
+		addTemplateError(source, text, err)
+	}
+}
+
+//
+// Check a template with its own engine and delimiters.  envsubst templates are only checked when rendered
+//
+func checkFileTemplate(source, text string, options templateOptions) {
+	if templateEngine(source, options) == "envsubst" {
+		return
+	}
+	if _, err := newOptionsTemplate(source, options).Parse(text); err != nil {
+		addTemplateError(source, text, err)
+	}
+}
+
+//
+// Arguments such as --wait and command arguments always use {{ }}
+//
+func newStringTemplate(source string) *template.Template {
+	return template.New(source).Funcs(funcMap)
+}
+
+//
+// Template files and inline templates use --delims
+//
+func newFileTemplate(source string) *template.Template {
+	tmpl := template.New(source).Funcs(funcMap)
+	if len(delims) > 0 {
+		tmpl = tmpl.Delims(delims[0], delims[1])
+	}
+	return tmpl
+}
+
+//
+// Name a template argument by its flag and position, such as --wait[2]
+//
+func flagSource(flagName string, i int) string {
+	return fmt.Sprintf("--%s[%d]", flagName, i+1)
+}
+
+func commandArgSource(cmdString string, i int) string {
+	return fmt.Sprintf("argument %d of `%s`", i, cmdString)
+}
+
+//
+// Parse every template argument before anything is done, so all the syntax errors are reported at once
+// instead of after half of the templates have been written
+//
+func checkTemplateArguments(commands Commands, args []string) {
+	for i, o := range overlaysFlag {
+		for _, part := range strings.Split(o, ":") {
+			checkTemplate(flagSource("overlay", i), part)
+		}
+	}
+	for i, t := range templatesFlag {
+		if template, dest, _, err := parseTemplate(t); err == nil {
+			checkTemplate(flagSource("template", i), template)
+			checkTemplate(flagSource("template", i), dest)
+		}
+	}
+	for i, t := range templatesInlineFlag {
+		if content, dest, options, err := parseInlineTemplate(t); err == nil {
+			checkFileTemplate(flagSource("template-inline", i), content, options)
+			checkTemplate(flagSource("template-inline", i), dest)
+		}
+	}
+	for i, d := range dataFlag {
+		if parts := strings.SplitN(d, "=", 2); len(parts) == 2 {
+			checkTemplate(flagSource("data", i), parts[1])
+		}
+	}
+	for i, f := range secretFilesFlag {
+		if parts := strings.SplitN(f, ":", 4); len(parts) > 1 {
+			checkTemplate(flagSource("secret-file", i), parts[1])
+		}
+	}
+	for i, host := range waitFlag {
+		checkTemplate(flagSource("wait", i), host)
+	}
+	for i, logFile := range stdoutTailFlag {
+		checkTemplate(flagSource("stdout", i), logFile)
+	}
+	for i, logFile := range stderrTailFlag {
+		checkTemplate(flagSource("stderr", i), logFile)
+	}
+
+	checkCommand := func(cmdArgs []string) {
+		cmdString := strings.Join(cmdArgs, " ")
+		for i, arg := range cmdArgs {
+			checkTemplate(commandArgSource(cmdString, i), arg)
+		}
+	}
+	for _, cmd := range commands.run {
+		checkCommand(cmd.Args)
+	}
+	for _, cmd := range commands.start {
+		checkCommand(cmd.Args)
+	}
+	checkCommand(args)
+}
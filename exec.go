@@ -17,20 +17,32 @@ func runCmd(ctx context.Context, cancel context.CancelFunc, cmd *exec.Cmd, cance
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-
-	if err := copySecretsFiles(cmd); err != nil {
-		log.Fatalf("Could not copy secrets files", err)
+	if redactSecretsFlag {
+		stdout, stderr := newRedactWriter(os.Stdout), newRedactWriter(os.Stderr)
+		defer stdout.Close()
+		defer stderr.Close()
+		cmd.Stdout, cmd.Stderr = stdout, stderr
 	}
 
+	cmdString := toString(cmd)
+	cmdContext := commandTemplateContext(cmd)
 	for i, arg := range cmd.Args {
-		cmd.Args[i] = string_template_eval(arg)
+		cmd.Args[i] = evalTemplateIn(cmdContext, commandArgSource(cmdString, i), arg)
+	}
+	exitOnTemplateErrors()
+
+	if err := copySecretsFiles(cmd); err != nil {
+		fatalAndCleanUp("Could not copy secrets files: %s", err)
+	}
+	if err := addSecretEnv(cmd); err != nil {
+		fatalAndCleanUp("%s", err)
 	}
 
 	// start the cmd
 	err := cmd.Start()
 	if err != nil {
 		// TODO: bubble the platform-specific exit code of the process up via global exitCode
-		log.Fatalf("Error starting command: `%s` - %s\n", toString(cmd), err)
+		fatalAndCleanUp("Error starting command: `%s` - %s\n", toString(cmd), err)
 	}
     if debugFlag && cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
         log.Printf("command running as uid %d", cmd.SysProcAttr.Credential.Uid)
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//
+// File-reading template functions.  e.g.
+//
+//   ssl_certificate_key {{ readFile "/etc/ssl/private/site.key" }};
+//   {{ range glob "/etc/conf.d/*.conf" }}{{ readFile . }}{{ end }}
+//
+// Templates can only read files under the directories allowed by --read-root, so they cannot be used
+// to exfiltrate arbitrary files.  Symbolic links are resolved before checking, so they cannot escape a root
+//
+
+//
+// Return the real path of path, or an error if it is not under one of the --read-root directories
+//
+func readablePath(path string) (string, error) {
+	if len(readRootsFlag) == 0 {
+		return "", fmt.Errorf("cannot read %s: no --read-root directories are allowed", path)
+	}
+	realPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(realPath); err == nil {
+		realPath = resolved
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	for _, root := range readRootsFlag {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			root = resolved
+		}
+		if realPath == root || strings.HasPrefix(realPath, strings.TrimSuffix(root, "/")+"/") {
+			return realPath, nil
+		}
+	}
+	return "", fmt.Errorf("cannot read %s: it is not under any --read-root directory", path)
+}
+
+func readFile(path string) (string, error) {
+	realPath, err := readablePath(path)
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(realPath)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+//
+// readFile without leading and trailing white space, handy for one-line files such as tokens
+//
+func readFileTrim(path string) (string, error) {
+	content, err := readFile(path)
+	return strings.TrimSpace(content), err
+}
+
+//
+// The sorted paths matching pattern, leaving out any that are not under a --read-root directory
+//
+func glob(pattern string) ([]string, error) {
+	if len(readRootsFlag) == 0 {
+		return nil, fmt.Errorf("cannot glob %s: no --read-root directories are allowed", pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	readable := []string{}
+	for _, match := range matches {
+		if _, err := readablePath(match); err == nil {
+			readable = append(readable, match)
+		}
+	}
+	return readable, nil
+}
+
+//
+// The sorted names of the entries in dir
+//
+func listDir(dir string) ([]string, error) {
+	realPath, err := readablePath(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(realPath)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//
+// The permission bits of path in octal, such as "0644"
+//
+func fileMode(path string) (string, error) {
+	realPath, err := readablePath(path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(realPath)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04o", fi.Mode().Perm()), nil
+}
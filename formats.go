@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+//
+// Data-format template functions, so structured configs can be parsed from, or generated into,
+// JSON, YAML and TOML.  e.g.
+//
+//   {{ range $name, $svc := fromJson .Env.SERVICES_JSON }}upstream {{ $name }} { server {{ $svc.host }}; }{{ end }}
+//   secrets: {{ .Secret | toYaml | nindent 2 }}
+//
+// YAML uses yaml.v3, the same library that reads YAML secrets and SOPS files
+//
+
+//
+// Numbers are decoded as json.Number, rather than float64, so integers above 2^53, such as ids, keep
+// every digit
+//
+func fromJson(s string) (interface{}, error) {
+	var v interface{}
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("fromJson: %s", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("fromJson: invalid data after the top-level value")
+	}
+	return v, nil
+}
+
+func toJson(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("toJson: %s", err)
+	}
+	return string(data), nil
+}
+
+func toPrettyJson(v interface{}) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("toPrettyJson: %s", err)
+	}
+	return string(data), nil
+}
+
+//
+// yaml decodes mappings with non-string keys as map[interface{}]interface{}, which neither
+// encoding/json nor templates can index by name, so convert them to map[string]interface{}, however
+// deeply they are nested
+//
+func normalizeYaml(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = normalizeYaml(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalizeYaml(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalizeYaml(value)
+		}
+	}
+	return v
+}
+
+func fromYaml(s string) (interface{}, error) {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return nil, fmt.Errorf("fromYaml: %s", err)
+	}
+	return normalizeYaml(v), nil
+}
+
+//
+// Indented by 2 spaces, as most YAML configs are, rather than yaml.v3's default of 4
+//
+func toYaml(v interface{}) (string, error) {
+	var result bytes.Buffer
+	encoder := yaml.NewEncoder(&result)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(v); err != nil {
+		return "", fmt.Errorf("toYaml: %s", err)
+	}
+	encoder.Close()
+	return strings.TrimSuffix(result.String(), "\n"), nil
+}
+
+func fromToml(s string) (map[string]interface{}, error) {
+	v := make(map[string]interface{})
+	if _, err := toml.Decode(s, &v); err != nil {
+		return nil, fmt.Errorf("fromToml: %s", err)
+	}
+	return v, nil
+}
+
+func toToml(v interface{}) (string, error) {
+	var result bytes.Buffer
+	if err := toml.NewEncoder(&result).Encode(v); err != nil {
+		return "", fmt.Errorf("toToml: %s", err)
+	}
+	return strings.TrimSuffix(result.String(), "\n"), nil
+}
+
+//
+// indent every line of s by n spaces: `{{ .Data | toYaml | indent 4 }}`
+//
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+//
+// indent, but start with a newline so the result can follow a key on the same line
+//
+func nindent(n int, s string) string {
+	return "\n" + indent(n, s)
+}
+
+//
+// double quote with Go/JSON escaping: `{{ quote .Secret.PASSWORD }}` --> "pa\"ss"
+//
+func quote(v interface{}) string {
+	return strconv.Quote(fmt.Sprint(v))
+}
+
+//
+// single quote, doubling any embedded single quotes as YAML and SQL require: it's --> 'it''s'
+//
+func squote(v interface{}) string {
+	return "'" + strings.Replace(fmt.Sprint(v), "'", "''", -1) + "'"
+}
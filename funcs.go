@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// Regex, math, list and date template functions.  Bad input is reported as a template error
+// instead of silently becoming zero or an empty string
+//
+
+func regexMatch(regex, s string) (bool, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return false, fmt.Errorf("regexMatch: %s", err)
+	}
+	return re.MatchString(s), nil
+}
+
+//
+// The first match of regex in s, or "" if there is none
+//
+func regexFind(regex, s string) (string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return "", fmt.Errorf("regexFind: %s", err)
+	}
+	return re.FindString(s), nil
+}
+
+//
+// Replace all matches of regex in s with replacement, which may refer to submatches as $1 or ${name}
+//
+func regexReplace(regex, s, replacement string) (string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return "", fmt.Errorf("regexReplace: %s", err)
+	}
+	return re.ReplaceAllString(s, replacement), nil
+}
+
+func sub(arg1, arg2 int) int {
+	return arg1 - arg2
+}
+
+func mul(arg1, arg2 int) int {
+	return arg1 * arg2
+}
+
+func div(arg1, arg2 int) (int, error) {
+	if arg2 == 0 {
+		return 0, fmt.Errorf("div: division by zero")
+	}
+	return arg1 / arg2, nil
+}
+
+func mod(arg1, arg2 int) (int, error) {
+	if arg2 == 0 {
+		return 0, fmt.Errorf("mod: division by zero")
+	}
+	return arg1 % arg2, nil
+}
+
+func maxInt(first int, rest ...int) int {
+	for _, v := range rest {
+		if v > first {
+			first = v
+		}
+	}
+	return first
+}
+
+func minInt(first int, rest ...int) int {
+	for _, v := range rest {
+		if v < first {
+			first = v
+		}
+	}
+	return first
+}
+
+//
+// Convert any slice or array to a []interface{} so the list functions accept []string, .Data lists, etc.
+//
+func toList(name string, list interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%s: expected a list, got %T", name, list)
+	}
+	result := make([]interface{}, v.Len())
+	for i := range result {
+		result[i] = v.Index(i).Interface()
+	}
+	return result, nil
+}
+
+func join(list interface{}, sep string) (string, error) {
+	items, err := toList("join", list)
+	if err != nil {
+		return "", err
+	}
+	s := make([]string, len(items))
+	for i, item := range items {
+		s[i] = fmt.Sprint(item)
+	}
+	return strings.Join(s, sep), nil
+}
+
+func first(list interface{}) (interface{}, error) {
+	items, err := toList("first", list)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("first: empty list")
+	}
+	return items[0], nil
+}
+
+func last(list interface{}) (interface{}, error) {
+	items, err := toList("last", list)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("last: empty list")
+	}
+	return items[len(items)-1], nil
+}
+
+//
+// The list without duplicates, in the order each item first appears
+//
+func uniq(list interface{}) ([]interface{}, error) {
+	items, err := toList("uniq", list)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[interface{}]bool)
+	result := []interface{}{}
+	for _, item := range items {
+		if item != nil && !reflect.TypeOf(item).Comparable() {
+			return nil, fmt.Errorf("uniq: cannot compare %T", item)
+		}
+		if !seen[item] {
+			seen[item] = true
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+//
+// The keys of a map such as .Env, .Secret or a .Data document, in no particular order
+//
+func keys(m interface{}) ([]string, error) {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("keys: expected a map with string keys, got %T", m)
+	}
+	result := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		result = append(result, key.String())
+	}
+	return result, nil
+}
+
+func sortedKeys(m interface{}) ([]string, error) {
+	result, err := keys(m)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+//
+// Format a time using a Go reference layout: `{{ now | dateFormat "2006-01-02" }}`
+//
+func dateFormat(layout string, t time.Time) string {
+	return t.Format(layout)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+//
+// Network and host introspection template functions, for configs that need the container's own
+// addresses, such as Kafka advertised listeners or an nginx resolver.  e.g.
+//
+//   advertised.listeners=PLAINTEXT://{{ interfaceIP "eth0" }}:9092
+//   resolver {{ range resolvers }}{{ . }} {{ end }};
+//
+
+var (
+	procNetRoute = "/proc/net/route"
+	resolvConf   = "/etc/resolv.conf"
+)
+
+func hostname() (string, error) {
+	return os.Hostname()
+}
+
+//
+// The first IPv4 address of the named network interface, or its first IPv6 address if it has no IPv4 address
+//
+func interfaceIP(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("interfaceIP: %s: %s", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("interfaceIP: %s: %s", name, err)
+	}
+	var ipv6 string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			return ip4.String(), nil
+		}
+		if ipv6 == "" {
+			ipv6 = ipNet.IP.String()
+		}
+	}
+	if ipv6 != "" {
+		return ipv6, nil
+	}
+	return "", fmt.Errorf("interfaceIP: %s has no IP addresses", name)
+}
+
+func lookupIP(host string) ([]string, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("lookupIP: %s", err)
+	}
+	result := make([]string, len(ips))
+	for i, ip := range ips {
+		result[i] = ip.String()
+	}
+	return result, nil
+}
+
+//
+// SRV records for name, sorted by priority and randomized by weight:
+// `{{ range lookupSRV "_kafka._tcp.example.com" }}{{ .Target }}:{{ .Port }}{{ end }}`
+//
+func lookupSRV(name string) ([]*net.SRV, error) {
+	_, srvs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("lookupSRV: %s", err)
+	}
+	return srvs, nil
+}
+
+//
+// The gateway of the default route, read from /proc/net/route
+//
+func defaultGateway() (string, error) {
+	routes, err := os.Open(procNetRoute)
+	if err != nil {
+		return "", fmt.Errorf("defaultGateway: %s", err)
+	}
+	defer routes.Close()
+
+	scanner := bufio.NewScanner(routes)
+	scanner.Scan() // skip the header line
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := hex.DecodeString(fields[2])
+		if err != nil || len(gateway) != 4 {
+			return "", fmt.Errorf("defaultGateway: bad gateway '%s' in %s", fields[2], procNetRoute)
+		}
+		// the kernel writes addresses in host (little endian) byte order
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gateway))
+		return ip.String(), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("defaultGateway: %s", err)
+	}
+	return "", fmt.Errorf("defaultGateway: no default route in %s", procNetRoute)
+}
+
+//
+// The nameservers listed in /etc/resolv.conf
+//
+func resolvers() ([]string, error) {
+	conf, err := os.Open(resolvConf)
+	if err != nil {
+		return nil, fmt.Errorf("resolvers: %s", err)
+	}
+	defer conf.Close()
+
+	var nameservers []string
+	scanner := bufio.NewScanner(conf)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("resolvers: %s", err)
+	}
+	return nameservers, nil
+}
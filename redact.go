@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"sort"
+	"sync"
+)
+
+//
+// --redact-secrets replaces the values of the loaded secrets, and their base64 encodings, with *** in the
+// output of --run, --start and primary commands, in tailed files, and in dockerfy's own log.  Values shorter
+// than redactMinLength are left alone, because redacting every "1" or "true" would garble the output.
+//
+// Command output is filtered as a stream, so a value split across two writes is still redacted: output
+// that could be the start of a value is held back until the next write shows whether it is, or until the
+// command exits
+//
+
+const redactMinLength = 4
+
+var (
+	redactMutex  sync.RWMutex
+	redactValues [][]byte
+	redactSeen   = make(map[string]bool)
+)
+
+//
+// Add secret values to those redacted.  Called whenever secrets are loaded
+//
+func addRedactedSecrets(secrets map[string]string) {
+	redactMutex.Lock()
+	defer redactMutex.Unlock()
+	redactValues = appendRedactValues(redactValues, redactSeen, secrets, redactMinLength)
+}
+
+//
+// Append the secret values of at least minLength, and their base64 encodings, that are not yet seen.
+// The longest values are matched first, so a secret that contains another is not partially revealed
+//
+func appendRedactValues(values [][]byte, seen map[string]bool, secrets map[string]string, minLength int) [][]byte {
+	for _, value := range secrets {
+		if len(value) < minLength {
+			continue
+		}
+		for _, v := range []string{value, base64.StdEncoding.EncodeToString([]byte(value)),
+			base64.RawStdEncoding.EncodeToString([]byte(value))} {
+			if !seen[v] {
+				seen[v] = true
+				values = append(values, []byte(v))
+			}
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return values
+}
+
+func redactedValues() [][]byte {
+	redactMutex.RLock()
+	defer redactMutex.RUnlock()
+	return redactValues
+}
+
+//
+// Redact the secret values in buf.  Unless final, rest is the end of buf that could be the start of a
+// value, which must wait for more output
+//
+func redactBytes(buf []byte, values [][]byte, final bool) (out []byte, rest []byte) {
+	var result bytes.Buffer
+	i := 0
+scan:
+	for i < len(buf) {
+		for _, v := range values {
+			if v[0] != buf[i] {
+				continue
+			}
+			if bytes.HasPrefix(buf[i:], v) {
+				result.WriteString("***")
+				i += len(v)
+				continue scan
+			}
+			if !final && len(buf)-i < len(v) && bytes.HasPrefix(v, buf[i:]) {
+				return result.Bytes(), buf[i:]
+			}
+		}
+		result.WriteByte(buf[i])
+		i++
+	}
+	return result.Bytes(), nil
+}
+
+//
+// A streaming redactor for the output of one command or tailed file
+//
+type redactWriter struct {
+	mutex   sync.Mutex
+	dest    io.Writer
+	pending []byte
+}
+
+func newRedactWriter(dest io.Writer) *redactWriter {
+	return &redactWriter{dest: dest}
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.write(append(w.pending, p...), false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//
+// Write out whatever is still held back
+//
+func (w *redactWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.write(w.pending, true)
+}
+
+func (w *redactWriter) write(buf []byte, final bool) error {
+	out, rest := redactBytes(buf, redactedValues(), final)
+	w.pending = append([]byte{}, rest...)
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := w.dest.Write(out)
+	return err
+}
+
+//
+// dockerfy's log writes whole lines, which are redacted without holding anything back, so nothing is
+// lost when log.Fatal exits
+//
+type redactLogWriter struct {
+	dest io.Writer
+}
+
+func (w redactLogWriter) Write(p []byte) (int, error) {
+	out, _ := redactBytes(p, redactedValues(), true)
+	if _, err := w.dest.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+//
+// --dry-run (or `dockerfy render`) evaluates everything dockerfy would do, but prints
+// the results instead of changing the container.  Secret values are always redacted, the way
+// --redact-secrets redacts them (see redact.go), including those too short for --redact-secrets.
+//
+
+//
+// Unlike --redact-secrets, every secret value is redacted, however short, so a PIN is not printed
+//
+func dryRunRedact(s string) string {
+	values := appendRedactValues(nil, make(map[string]bool), currentTemplateContext().secretsMap(), 1)
+	out, _ := redactBytes([]byte(s), values, true)
+	return string(out)
+}
+
+func dryRunPrintf(format string, args ...interface{}) {
+	fmt.Print(dryRunRedact(fmt.Sprintf(format, args...)))
+}
+
+func dryRunOverlay(src, dest string) {
+	dryRunPrintf("overlay: %s --> %s\n", src, dest)
+}
+
+//
+// Print the rendered template, or a unified diff against the existing destination file
+//
+func dryRunTemplate(templatePath string, content []byte, destPath string) {
+	rendered := dryRunRedact(string(content))
+
+	if destPath == "" {
+		dryRunPrintf("template: %s --> stdout\n", templatePath)
+		fmt.Print(rendered)
+		return
+	}
+
+	existing, err := ioutil.ReadFile(destPath)
+	if os.IsNotExist(err) {
+		dryRunPrintf("template: %s --> %s (new file)\n", templatePath, destPath)
+		fmt.Print(rendered)
+		return
+	} else if err != nil {
+		log.Fatalf("unable to read %s: %s", destPath, err)
+	}
+
+	diff := unifiedDiff(destPath, destPath+" (rendered from "+templatePath+")",
+		dryRunRedact(string(existing)), rendered, 3)
+	if diff == "" {
+		dryRunPrintf("template: %s --> %s (unchanged)\n", templatePath, destPath)
+		return
+	}
+	dryRunPrintf("template: %s --> %s\n", templatePath, destPath)
+	fmt.Print(diff)
+}
+
+func dryRunWaits() {
+	for i, host := range waitFlag {
+		host = string_template_eval(flagSource("wait", i), host)
+		if host == "" {
+			continue
+		}
+		u, err := url.Parse(host)
+		if err != nil {
+			log.Fatalf("bad hostname provided: %s. %s", host, err.Error())
+		}
+		switch u.Scheme {
+		case "tcp", "tcp4", "tcp6", "http", "https":
+		default:
+			log.Fatalf("invalid host protocol provided: %s. supported protocols are: tcp, tcp4, tcp6, http and https", u.Scheme)
+		}
+		dryRunPrintf("wait: %s (timeout %s)\n", host, waitTimeoutFlag)
+	}
+}
+
+func dryRunCommand(kind string, cmd *exec.Cmd) {
+	args := make([]string, len(cmd.Args))
+	cmdString := toString(cmd)
+	cmdContext := commandTemplateContext(cmd)
+	for i, arg := range cmd.Args {
+		args[i] = evalTemplateIn(cmdContext, commandArgSource(cmdString, i), arg)
+	}
+	user := ""
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		user = fmt.Sprintf(" (uid %d)", cmd.SysProcAttr.Credential.Uid)
+	}
+	env := ""
+	if len(commandSecretEnvs[cmd]) > 0 {
+		if _, err := secretEnvLines(cmd, cmdContext.secretsMap()); err != nil {
+			log.Fatal(err)
+		}
+		env = fmt.Sprintf(" (secret env %s)", strings.Join(commandSecretEnvs[cmd], ", "))
+	}
+	dryRunPrintf("%s: %s%s%s\n", kind, strings.Join(args, " "), user, env)
+}
+
+//
+// Print the tail files and commands that would be run, in the order they would run
+//
+func dryRunCommands(commands Commands, primary_command *exec.Cmd) {
+	for _, cmd := range commands.run {
+		dryRunCommand("run", cmd)
+	}
+	for i, logFile := range stdoutTailFlag {
+		dryRunPrintf("stdout: %s\n", string_template_eval(flagSource("stdout", i), logFile))
+	}
+	for i, logFile := range stderrTailFlag {
+		dryRunPrintf("stderr: %s\n", string_template_eval(flagSource("stderr", i), logFile))
+	}
+	for _, cmd := range commands.start {
+		dryRunCommand("start", cmd)
+	}
+	if primary_command != nil {
+		dryRunCommand("command", primary_command)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+//
+// --secrets-scope limits the secrets seen by the following --run and --start commands and the primary
+// command, the way --user sets their user account.  e.g.
+//
+//   --secrets-scope 'DB_ADMIN_*' --run migrate -- --secrets-scope 'PROXY_*' nginx
+//
+// The scope is a comma-separated list of glob patterns for the names of secrets (as flattened, such as
+// db.password).  Patterns starting with ! exclude secrets, so '!DB_ADMIN_*' is every secret except those.
+// A secret is in scope if it matches a pattern, or there are only ! patterns, and matches no ! pattern.
+// '*' gives the following commands every secret again.
+//
+// A scoped command's arguments are evaluated with only the secrets in scope, its combined_secrets.json
+// has only them, and it gets copies of only those secrets files whose secrets are all in scope
+//
+
+type secretsScope struct {
+	spec    string
+	include []string
+	exclude []string
+}
+
+func parseSecretsScope(spec string) (*secretsScope, error) {
+	if strings.TrimSpace(spec) == "*" {
+		return nil, nil
+	}
+	scope := &secretsScope{spec: spec}
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		exclude := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if pattern == "" {
+			return nil, fmt.Errorf("empty pattern in '%s'", spec)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern '%s': %s", pattern, err)
+		}
+		if exclude {
+			scope.exclude = append(scope.exclude, pattern)
+		} else {
+			scope.include = append(scope.include, pattern)
+		}
+	}
+	return scope, nil
+}
+
+func (s *secretsScope) allows(name string) bool {
+	if s == nil {
+		return true
+	}
+	for _, pattern := range s.exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(s.include) == 0 {
+		return true
+	}
+	for _, pattern := range s.include {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// A short name for the scope, so the copies of secrets files for each scope go in their own directory
+//
+func (s *secretsScope) id() string {
+	sum := sha1.Sum([]byte(s.spec))
+	return hex.EncodeToString(sum[:4])
+}
+
+var commandScopes = make(map[*exec.Cmd]*secretsScope)
+
+//
+// The template context for evaluating a command's arguments, with only the secrets in its scope
+//
+func commandTemplateContext(cmd *exec.Cmd) *TemplateContext {
+	if scope := commandScopes[cmd]; scope != nil {
+		return &TemplateContext{scope: scope}
+	}
+	return currentTemplateContext()
+}
+
+//
+// Take the secrets in scope from the snapshot
+//
+func (c *TemplateContext) loadScopedSecrets(snapshot *TemplateContext) {
+	snapshot.loadSecrets()
+	c.secretsEncrypted = snapshot.secretsEncrypted
+
+	c.secrets = make(map[string]string)
+	for name, value := range snapshot.secrets {
+		if c.scope.allows(name) {
+			c.secrets[name] = value
+		}
+	}
+	c.secretTree = make(map[string]interface{})
+	for key, value := range snapshot.secretTree {
+		if scoped, ok := c.scopeSecretTree(key, value); ok {
+			c.secretTree[key] = scoped
+		}
+	}
+	for _, fileName := range snapshot.secretsFileNames {
+		if c.allowsAll(snapshot.secretsFileKeys[fileName]) {
+			c.secretsFileNames = append(c.secretsFileNames, fileName)
+		}
+	}
+}
+
+//
+// The part of a nested secret that is in scope.  Lists and values are kept whole or not at all
+//
+func (c *TemplateContext) scopeSecretTree(name string, value interface{}) (interface{}, bool) {
+	if m, ok := value.(map[string]interface{}); ok {
+		scoped := make(map[string]interface{})
+		for key, item := range m {
+			if s, ok := c.scopeSecretTree(joinSecretName(name, key), item); ok {
+				scoped[key] = s
+			}
+		}
+		return scoped, len(scoped) > 0
+	}
+	flat := make(map[string]string)
+	flattenSecrets(name, value, flat)
+	names := make([]string, 0, len(flat))
+	for n := range flat {
+		names = append(names, n)
+	}
+	return value, c.allowsAll(names)
+}
+
+func (c *TemplateContext) allowsAll(names []string) bool {
+	for _, name := range names {
+		if !c.scope.allows(name) {
+			return false
+		}
+	}
+	return true
+}
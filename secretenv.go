@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+//
+// --secret-env NAME[=SECRET] puts one secret into the environment of the next --run or --start command, or
+// of the primary command, for programs that only take a password from the environment.  e.g.
+//
+//   --secret-env PGPASSWORD=DB_ADMIN_PASSWORD --run psql -f /app/migrate.sql --
+//
+// SECRET defaults to NAME, and must be in the command's --secrets-scope.  dockerfy's own environment,
+// and that of every other command, is left alone
+//
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var commandSecretEnvs = make(map[*exec.Cmd][]string)
+
+func checkSecretEnv(spec string) error {
+	name := strings.SplitN(spec, "=", 2)[0]
+	if !envVarName.MatchString(name) {
+		return fmt.Errorf("bad environment variable name '%s'", name)
+	}
+	if strings.HasSuffix(spec, "=") {
+		return fmt.Errorf("no secret name after '%s'", spec)
+	}
+	return nil
+}
+
+//
+// The NAME=value lines for a command's --secret-env options
+//
+func secretEnvLines(cmd *exec.Cmd, secrets map[string]string) ([]string, error) {
+	lines := []string{}
+	for _, spec := range commandSecretEnvs[cmd] {
+		parts := strings.SplitN(spec, "=", 2)
+		name, key := parts[0], parts[0]
+		if len(parts) == 2 {
+			key = parts[1]
+		}
+		value, ok := secrets[key]
+		if !ok {
+			return nil, fmt.Errorf("--secret-env %s: no secret named %s in the scope of `%s`", spec, key, toString(cmd))
+		}
+		lines = append(lines, name+"="+value)
+	}
+	return lines, nil
+}
+
+//
+// Add the command's --secret-env variables to its environment, replacing any that are already set
+//
+func addSecretEnv(cmd *exec.Cmd) error {
+	if len(commandSecretEnvs[cmd]) == 0 {
+		return nil
+	}
+	lines, err := secretEnvLines(cmd, commandTemplateContext(cmd).secretsMap())
+	if err != nil {
+		return err
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	env := []string{}
+	for _, envLine := range cmd.Env {
+		replaced := envLine == ""
+		for _, line := range lines {
+			if strings.HasPrefix(envLine, line[:strings.Index(line, "=")+1]) {
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, envLine)
+		}
+	}
+	cmd.Env = append(env, lines...)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//
+// --secret-file KEY[:PATH[:MODE[:OWNER]]] writes the value of one secret to a file of its own, for programs
+// that take a --password-file, a TLS key or a .pgpass file.  e.g.
+//
+//   --secret-file DB_PASSWORD:/run/app/db_password:0400:app
+//   --run psql --password-file '{{ secretFile "DB_PASSWORD" }}' --
+//
+// PATH defaults to KEY in the files directory of --secrets-dest, which is on a tmpfs, MODE to 0400 and
+// OWNER to root.  The files are written after the --wait hosts are up, before any command runs, and removed
+// with the copies of the secrets files when dockerfy exits.  The secretFile template function returns the
+// path of a secret's file, so the value itself never appears in a command line.  A command with a
+// --secrets-scope can only get the paths of the secrets in its scope
+//
+
+type secretFileSpec struct {
+	key   string
+	path  string
+	mode  os.FileMode
+	owner string
+}
+
+var (
+	secretFileSpecs []secretFileSpec
+	secretFilePaths = make(map[string]string)
+)
+
+//
+// Parse the --secret-file options, evaluating their paths
+//
+func parseSecretFiles() {
+	for i, spec := range secretFilesFlag {
+		parts := strings.SplitN(spec, ":", 4)
+		f := secretFileSpec{key: parts[0], mode: 0400}
+		if f.key == "" {
+			log.Fatalf("bad secret-file argument: '%s'. expected \"KEY[:/path[:mode[:owner]]]\"", spec)
+		}
+		if _, ok := secretFilePaths[f.key]; ok {
+			log.Fatalf("more than one --secret-file for %s", f.key)
+		}
+		if len(parts) > 1 && parts[1] != "" {
+			f.path = string_template_eval(flagSource("secret-file", i), parts[1])
+		} else {
+			f.path = filepath.Join(secretsDestDir(), "files", strings.Replace(f.key, "/", "_", -1))
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			// setuid, setgid and sticky bits mean nothing on a file of secrets, so only permissions are allowed
+			mode, err := strconv.ParseUint(parts[2], 8, 32)
+			if err != nil || mode > 0777 {
+				log.Fatalf("bad mode '%s' for --secret-file %s. expected an octal mode from 0000 to 0777, such as 0400", parts[2], f.key)
+			}
+			f.mode = os.FileMode(mode)
+		}
+		if len(parts) > 3 {
+			f.owner = parts[3]
+		}
+		secretFileSpecs = append(secretFileSpecs, f)
+		secretFilePaths[f.key] = f.path
+	}
+}
+
+//
+// secretFile template function: the path of the --secret-file for key
+//
+func secretFile(key string) (string, error) {
+	path, ok := secretFilePaths[key]
+	if !ok {
+		return "", fmt.Errorf("secretFile: no --secret-file for %s", key)
+	}
+	return path, nil
+}
+
+//
+// secretFile for a command with a --secrets-scope, which may only name the files of secrets in its scope
+//
+func (c *TemplateContext) secretFile(key string) (string, error) {
+	if c.scope != nil && !c.scope.allows(key) {
+		return "", fmt.Errorf("secretFile: %s is not in --secrets-scope '%s'", key, c.scope.spec)
+	}
+	return secretFile(key)
+}
+
+//
+// Write each --secret-file, with exactly its mode and owner
+//
+func writeSecretFiles() {
+	secrets := currentTemplateContext().secretsMap()
+	// check them all first, so a mistake does not leave some of them behind
+	for _, f := range secretFileSpecs {
+		if _, ok := secrets[f.key]; !ok {
+			fatalAndCleanUp("--secret-file %s: no secret named %s", f.key, f.key)
+		}
+	}
+	for _, f := range secretFileSpecs {
+		value := secrets[f.key]
+		if dryRunFlag {
+			owner := ""
+			if f.owner != "" {
+				owner = ", owner " + f.owner
+			}
+			dryRunPrintf("secret-file: %s --> %s (mode %04o%s)\n", f.key, f.path, f.mode, owner)
+			continue
+		}
+		if err := writeSecretFile(f, value); err != nil {
+			fatalAndCleanUp("unable to write --secret-file %s to %s: %s", f.key, f.path, err)
+		}
+		if verboseFlag {
+			log.Printf("secret %s --> %s\n", f.key, f.path)
+		}
+	}
+}
+
+func writeSecretFile(f secretFileSpec, value string) error {
+	uid, gid, err := templateOwner(templateOptions{owner: f.owner})
+	if err != nil {
+		return err
+	}
+
+	fileSysCreateMutex.Lock()
+	defer fileSysCreateMutex.Unlock()
+
+	if err := mkdirAllCopiedSecrets(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	// Replace any existing file, rather than writing the secret into a file with some other mode or owner
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	copiedSecretsPaths = append(copiedSecretsPaths, f.path)
+
+	if _, err := out.WriteString(value); err != nil {
+		return err
+	}
+	if err := out.Chmod(f.mode); err != nil {
+		return err
+	}
+	if uid != -1 {
+		return out.Chown(uid, gid)
+	}
+	return nil
+}
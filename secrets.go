@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -13,6 +13,8 @@ import (
 	"strconv"
 	"strings"
     "sync"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Mutex to protect critical regions when performing file system related activities
@@ -49,109 +51,300 @@ func copyFileContents(src, dst string) error {
 }
 
 //
-// return a list of secrets file names from the --secrets-files option and env var  $SECRETS_FILES
+// return a list of secrets files and urls from the --secrets, --secrets-dir and --secrets-files options and env var  $SECRETS_FILES
 //
 // Secrets can come from (in order of precedence):
-// 1) --secrets-file <file> (one or more times)
-// 2) $SECRETS_FILES
-func getSecretsFileNames() []string {
+// 1) --secrets <file or url> (one or more times)
+// 2) --secrets-dir <dir> (one or more times)
+// 3) --secrets-file <file> (one or more times)
+// 4) $SECRETS_FILES
+func getSecretsSources() []string {
 
-	var secretsFileNames []string
-	//:= make([]string, len(secretsFilesFlag)+len(strings.Split(os.Getenv("SECRETS_FILES"), ":"))+1)
+	var secretsSources []string
+	var labels []string // where each source came from, for template error messages
 
 	// backward compatibility for OLD env var
 	if os.Getenv("SECRETS_FILE") != "" {
 		log.Println("Warning $SECRETS_FILE is deprecated, use $SECRETS_FILES instead")
-		secretsFileNames = append(secretsFileNames, os.Getenv("SECRETS_FILE"))
+		secretsSources = append(secretsSources, os.Getenv("SECRETS_FILE"))
+		labels = append(labels, "$SECRETS_FILE")
 	}
 	if os.Getenv("SECRETS_FILES") != "" {
-		secretsFileNames = append(secretsFileNames, strings.Split(os.Getenv("SECRETS_FILES"), ":")...)
+		for i, fileName := range strings.Split(os.Getenv("SECRETS_FILES"), ":") {
+			secretsSources = append(secretsSources, fileName)
+			labels = append(labels, fmt.Sprintf("$SECRETS_FILES[%d]", i+1))
+		}
 	}
 	// Command line options override the environment, so we process those LAST
-	for _, secretsFileName := range secretsFilesFlag {
-		secretsFileNames = append(secretsFileNames, strings.Split(secretsFileName, ":")...)
+	for i, source := range secretsFilesFlag {
+		for _, fileName := range strings.Split(source, ":") {
+			secretsSources = append(secretsSources, fileName)
+			labels = append(labels, flagSource("secrets-files", i))
+		}
+	}
+	for i, dir := range secretsDirsFlag {
+		secretsSources = append(secretsSources, "dir://"+dir)
+		labels = append(labels, flagSource("secrets-dir", i))
+	}
+	for i, source := range secretsFlag {
+		secretsSources = append(secretsSources, source)
+		labels = append(labels, flagSource("secrets", i))
 	}
 	// Allow template substitutions in file names.   Works for {{ .Env.VAR }}, but not for {{ .Secret.VAR }}
-	for i, secretsFileName := range secretsFileNames {
-		secretsFileNames[i] = string_template_eval(secretsFileName)
+	for i, source := range secretsSources {
+		secretsSources[i] = file_name_template_eval(labels[i], source)
 	}
+	exitOnTemplateErrors()
 
-	return secretsFileNames
+	return secretsSources
 }
 
 //
-// return a map of secrets
+// A source of secrets, such as a secrets file or a Vault KV path
 //
-func getSecrets() map[string]string {
+type SecretsProvider interface {
+	// the name of the source in messages, without any credentials
+	Name() string
+	// the secrets, which may be nested documents.  They are flattened into .Secret by getSecrets
+	Secrets() (map[string]interface{}, error)
+}
 
-	secrets := make(map[string]string)
+//
+// Implemented by providers whose secrets were decrypted in memory, and so must not be written to disk
+//
+type encryptedSecretsProvider interface {
+	Encrypted() bool
+}
 
-	for _, secretsFileName := range getSecretsFileNames() {
+//
+// A secrets file, which may be encrypted with age or SOPS
+//
+type fileSecretsProvider struct {
+	path      string
+	encrypted bool
+}
 
-		secretsFile, err := os.Open(secretsFileName)
+func (p *fileSecretsProvider) Name() string {
+	return p.path
+}
+
+func (p *fileSecretsProvider) Secrets() (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	secrets, encrypted, err := parseSecrets(p.path, content)
+	p.encrypted = encrypted
+	return secrets, err
+}
+
+func (p *fileSecretsProvider) Encrypted() bool {
+	return p.encrypted
+}
+
+//
+// A directory with one secret per file, named by the file, such as the /run/secrets that Docker swarm
+// mounts, or a Kubernetes secret volume.  Hidden entries, such as the ..data symlink and the timestamped
+// directory behind it that Kubernetes uses to update secrets atomically, are skipped, but the symlinks
+// to them are followed.  Dangling symlinks, and other entries that cannot be found, are skipped too
+//
+type dirSecretsProvider struct {
+	dir string
+}
+
+func (p dirSecretsProvider) Name() string {
+	return p.dir
+}
+
+func (p dirSecretsProvider) Secrets() (map[string]interface{}, error) {
+	entries, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]interface{})
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(p.dir, entry.Name())
+		fi, err := os.Stat(path)
 		if err != nil {
-			log.Fatalf("Error opening secrets file '%s':%s", secretsFileName, err)
+			// such as a dangling symlink, which should not hide the other secrets
+			log.Printf("skipping %s: %s", path, err)
+			continue
 		}
-		if verboseFlag {
-			log.Printf("Loading secrets from: %s:", secretsFileName)
-		}
-		defer secretsFile.Close()
-		bSecretsFile := bufio.NewReader(secretsFile)
-
-		if strings.HasSuffix(secretsFileName, ".env") {
-			for {
-				line_bytes, isPrefix, err := bSecretsFile.ReadLine()
-				line := string(line_bytes)
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					log.Fatalf("Error reading secrets file '%s':%s", secretsFileName, err)
-				}
-				if isPrefix {
-					log.Fatal("Error secrets file too long: ", secretsFileName)
-				}
-				if strings.HasPrefix(line, "#") {
-					continue
-				}
-				parts := strings.SplitN(line, "=", 2)
-				if len(parts) < 2 {
-					continue
-				}
-				key, value := parts[0], strings.Trim(strings.TrimSpace(parts[1]), `'"`)
-				secrets[key] = value
-				if debugFlag {
-					log.Printf("loaded secret: %s", key)
-				}
-			}
-		} else if strings.HasSuffix(secretsFileName, ".json") {
-			jsonData, err := ioutil.ReadAll(secretsFile)
-			if err != nil {
-				log.Fatalf("Error reading JSON secrets file '%s':%s", secretsFileName, err)
-			}
-			err = json.Unmarshal(jsonData, &secrets)
-			if err != nil {
-				log.Fatalf("Error reading JSON secrets file '%s':%s", secretsFileName, err)
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value := string(content)
+		if secretsTrimFlag {
+			value = strings.TrimSuffix(strings.TrimSuffix(value, "\n"), "\r")
+		}
+		secrets[entry.Name()] = value
+	}
+	return secrets, nil
+}
+
+//
+// Choose the provider for a secrets source by its URL scheme, or by the extension of a file
+//
+func newSecretsProvider(source string) (SecretsProvider, error) {
+	switch {
+	case strings.HasPrefix(source, "vault://"):
+		return newVaultSecretsProvider(source)
+	case strings.HasPrefix(source, "dir://"):
+		return dirSecretsProvider{strings.TrimPrefix(source, "dir://")}, nil
+	case strings.HasSuffix(source, ".age"):
+		return ageFileSecretsProvider{source}, nil
+	case strings.HasSuffix(source, ".env"), strings.HasSuffix(source, ".json"), strings.HasSuffix(source, ".toml"),
+		strings.HasSuffix(source, ".yaml"), strings.HasSuffix(source, ".yml"):
+		return &fileSecretsProvider{path: source}, nil
+	}
+	return nil, fmt.Errorf("Unknown file extension '%s' must end with .env, .json, .yaml, .yml, .toml or .age", source)
+}
+
+//
+// Parse the contents of a secrets file, chosen by the extension of its name: NAME=VALUE lines for .env,
+// and documents for .json, .yaml, .yml and .toml, which may be encrypted with SOPS (except for .toml).
+// encrypted is true for SOPS files
+//
+func parseSecrets(name string, content []byte) (secrets map[string]interface{}, encrypted bool, err error) {
+	var doc interface{}
+	switch filepath.Ext(name) {
+	case ".env":
+		vars, err := readEnvFile(content)
+		if err != nil {
+			return nil, false, err
+		}
+		secrets = make(map[string]interface{}, len(vars))
+		for key, value := range vars {
+			secrets[key] = value
+		}
+		return secrets, false, nil
+	case ".toml":
+		doc, err = fromToml(string(content))
+	case ".json":
+		if doc, err = fromJson(string(content)); err != nil {
+			return
+		}
+		if m, ok := doc.(map[string]interface{}); ok && m["sops"] != nil {
+			var node *yaml.Node
+			if node, err = jsonToNode(content); err != nil {
+				return
 			}
-			for key, value := range secrets {
-				secrets[key] = value
-				if debugFlag {
-					log.Printf("loaded secret: %s", key)
-				}
+			secrets, err = sopsDecrypt(node)
+			return secrets, true, err
+		}
+	default:
+		var node yaml.Node
+		if err = yaml.Unmarshal(content, &node); err != nil {
+			return
+		}
+		if isSopsDocument(&node) {
+			secrets, err = sopsDecrypt(&node)
+			return secrets, true, err
+		}
+		doc, err = fromYaml(string(content))
+	}
+	if err != nil {
+		return
+	}
+	secrets, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, false, fmt.Errorf("expected a dictionary of secrets")
+	}
+	return secrets, false, nil
+}
+
+//
+// Flatten nested secrets into names joined by --secrets-separator, such as db.password, so every value
+// is a string in .Secret.  List items are named by their index, and other scalars are formatted as strings
+//
+func flattenSecrets(prefix string, value interface{}, flat map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			flattenSecrets(joinSecretName(prefix, key), item, flat)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenSecrets(joinSecretName(prefix, strconv.Itoa(i)), item, flat)
+		}
+	case nil:
+		flat[prefix] = ""
+	case float64:
+		flat[prefix] = strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		flat[prefix] = v.String()
+	default:
+		flat[prefix] = fmt.Sprint(v)
+	}
+}
+
+func joinSecretName(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + secretsSeparatorFlag + key
+}
+
+//
+// Is the secrets source a file, rather than a remote service such as vault://
+//
+func isSecretsFile(source string) bool {
+	return !strings.Contains(source, "://")
+}
+
+//
+// return a map of secrets, merged from all the sources in order, so later sources override earlier ones.
+// tree is the same secrets, deep-merged without flattening.  encrypted is true if any of them were
+// decrypted in memory.  sourceKeys are the names of the secrets from each source
+//
+func getSecrets(sources []string) (secrets map[string]string, tree map[string]interface{}, encrypted bool, sourceKeys map[string][]string, err error) {
+
+	secrets = make(map[string]string)
+	tree = make(map[string]interface{})
+	sourceKeys = make(map[string][]string)
+
+	for _, source := range sources {
+		provider, err := newSecretsProvider(source)
+		if err != nil {
+			return nil, nil, false, nil, fmt.Errorf("Error loading secrets from '%s':%s", source, err)
+		}
+		if verboseFlag {
+			log.Printf("Loading secrets from: %s:", provider.Name())
+		}
+		providerSecrets, err := provider.Secrets()
+		if err != nil {
+			return nil, nil, false, nil, fmt.Errorf("Error reading secrets from '%s':%s", provider.Name(), err)
+		}
+		if p, ok := provider.(encryptedSecretsProvider); ok && p.Encrypted() {
+			encrypted = true
+		}
+		flat := make(map[string]string)
+		flattenSecrets("", providerSecrets, flat)
+		for key, value := range flat {
+			secrets[key] = value
+			sourceKeys[source] = append(sourceKeys[source], key)
+			if debugFlag {
+				log.Printf("loaded secret: %s", key)
 			}
-		} else {
-			log.Fatalf("Unknown file extension '%s' must end with .env or .json\n", secretsFileName)
 		}
+		deepMerge(tree, providerSecrets)
 		log.Println("")
 	}
-	return secrets
+	return secrets, tree, encrypted, sourceKeys, nil
 }
 
 // Note that secrets files are typically readable only the root user, and node programs and python programs
 // may benefit from the illusion that there is a single SECRETS_FILE (combining all keys)
 //
 // If this command is running under a different user account, then copy the SECRETS_FILES
-// and --secret-files into the home directory .secrets (as an emphermeral file)
+// and --secret-files into a directory for that user under --secrets-dest (as emphermeral files)
 // and make them readable by the by the user account in case the application wants
 // to read the file directly, instead of just using a template to alter a config file.
 //
@@ -166,9 +359,12 @@ func copySecretsFiles(cmd *exec.Cmd) error {
 	//  return nil
 	// }
 
-	// If we are not running in a container, then do not copy secrets files because the copies
-	// will not be ephemeral
-	if _, err := os.Stat("/.dockerenv"); os.IsNotExist(err) {
+	if secretsDestFlag == "none" {
+		return nil
+	}
+	// If we are not running in a container, then do not copy secrets files unless we were told where,
+	// because the copies will not be ephemeral
+	if secretsDestFlag == "" && !inContainer() {
 		return nil
 	}
 
@@ -197,16 +393,26 @@ func copySecretsFiles(cmd *exec.Cmd) error {
 			}
 		}
 
-		secretsDir := cmdUser.HomeDir + "/.secrets/"
+		// Each --secrets-scope gets its own copies, with only the secrets in scope
+		cmdContext := commandTemplateContext(cmd)
+		secretsDir := userSecretsDir(cmdUser)
+		if scope := commandScopes[cmd]; scope != nil {
+			secretsDir += "-" + scope.id()
+		}
+		secretsDir += "/"
 
-		cmd.Env[envCount] = "SECRETS_FILE=" + secretsDir + "combined_secrets.json"
-		envCount++
+		// Encrypted secrets are only ever decrypted in memory, so they are not combined into a plaintext file
+		combine := !cmdContext.secretsAreEncrypted()
+		if combine {
+			cmd.Env[envCount] = "SECRETS_FILE=" + secretsDir + "combined_secrets.json"
+			envCount++
+		}
 
 		// Rebase all individual secrets-files paths to secretsDir
-		secretsFileNames := getSecretsFileNames()
+		secretsFileNames := cmdContext.secretsFiles()
 		newSecretsFileNames := make([]string, len(secretsFileNames))
 
-		for i, secretsFileName := range getSecretsFileNames() {
+		for i, secretsFileName := range secretsFileNames {
 			newSecretsFileNames[i] = secretsDir + filepath.Base(secretsFileName)
 		}
 		cmd.Env[envCount] = "SECRETS_FILES=" + strings.Join(newSecretsFileNames, ":")
@@ -215,37 +421,45 @@ func copySecretsFiles(cmd *exec.Cmd) error {
 		// If we have not already done so, then copy all the secrets files to secretsDir
 		// and write the combined_secrets.json file
 
-		if _, err := os.Stat(secretsDir); err == nil {
+		if copiedSecretsDirs[secretsDir] {
 			// we've already created it for some other Cmd run as this cmdUser
 			return nil
 		}
 
-		// Create ~/.secrets dir for the cmdUser
-		if _, err := os.Stat(secretsDir); os.IsNotExist(err) {
-			// path/to/whatever does not exist
-			if err := os.Mkdir(secretsDir, 0700); err != nil {
-				return err
-			}
-			if err := os.Chown(secretsDir, cmdUid, cmdGid); err != nil {
-				return err
-			}
+		// Create the secretsDir for the cmdUser
+		if err := mkdirAllCopiedSecrets(secretsDir, 0700); err != nil {
+			return err
+		}
+		if err := os.Chmod(secretsDir, 0700); err != nil {
+			return err
 		}
+		if err := os.Chown(secretsDir, cmdUid, cmdGid); err != nil {
+			return err
+		}
+		copiedSecretsDirs[secretsDir] = true
 
 		// Create a combined secrets file with all secrets
-		if jsonData, err := json.MarshalIndent(getSecrets(), "", "    "); err == nil {
-			if err := ioutil.WriteFile(secretsDir+"combined_secrets.json", jsonData, 0400); err != nil {
+		if combine {
+			jsonData, err := json.MarshalIndent(cmdContext.secretsMap(), "", "    ")
+			if err != nil {
 				return err
 			}
-			if err := os.Chown(secretsDir+"combined_secrets.json", cmdUid, cmdGid); err != nil {
+			combinedName := secretsDir + "combined_secrets.json"
+			os.Remove(combinedName)
+			copiedSecretsPaths = append(copiedSecretsPaths, combinedName)
+			if err := ioutil.WriteFile(combinedName, jsonData, 0400); err != nil {
+				return err
+			}
+			if err := os.Chown(combinedName, cmdUid, cmdGid); err != nil {
 				return err
 			}
-		} else {
-			return err
 		}
 
 		// Copy all the individual secrets files into secretsDir
-		for _, secretsFileName := range getSecretsFileNames() {
-			copyName := secretsDir + "/" + filepath.Base(secretsFileName)
+		for _, secretsFileName := range secretsFileNames {
+			copyName := secretsDir + filepath.Base(secretsFileName)
+			os.Remove(copyName)
+			copiedSecretsPaths = append(copiedSecretsPaths, copyName)
 			if err := copyFileContents(secretsFileName, copyName); err != nil {
 				return err
 			}
@@ -261,3 +475,103 @@ func copySecretsFiles(cmd *exec.Cmd) error {
 
 	return nil
 }
+
+//
+// --secrets-dest is where copies of the secrets files are written for each user account:
+//
+//   (default)   /run/dockerfy/secrets/<uid> if /run is a tmpfs, otherwise /dev/shm/dockerfy/secrets/<uid>
+//   /some/dir   /some/dir/<uid>
+//   home        ~/.secrets, as in earlier versions of dockerfy
+//   none        do not copy secrets files at all
+//
+// Everything copied is removed when dockerfy exits
+//
+
+var (
+	copiedSecretsDirs  = make(map[string]bool)
+	copiedSecretsPaths []string
+	secretsDestOnce    sync.Once
+	secretsDest        string
+)
+
+func userSecretsDir(cmdUser *user.User) string {
+	if secretsDestFlag == "home" {
+		return filepath.Join(cmdUser.HomeDir, ".secrets")
+	}
+	return filepath.Join(secretsDestDir(), cmdUser.Uid)
+}
+
+//
+// The --secrets-dest directory, or a tmpfs if it is not a directory
+//
+func secretsDestDir() string {
+	secretsDestOnce.Do(func() {
+		secretsDest = secretsDestFlag
+		if secretsDest == "" || secretsDest == "home" || secretsDest == "none" {
+			secretsDest = "/run/dockerfy/secrets"
+			if !isTmpfs("/run") && isTmpfs("/dev/shm") {
+				secretsDest = "/dev/shm/dockerfy/secrets"
+			}
+		}
+		if dir := existingParent(secretsDest); !isTmpfs(dir) {
+			log.Printf("Warning: %s is not on a tmpfs, so copies of secrets files may be written to disk", secretsDest)
+		}
+	})
+	return secretsDest
+}
+
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+//
+// Like os.MkdirAll, but remembers the directories it creates so they are removed with the copies.
+// The parents of dir are readable by everyone, so each user can reach their own directory
+//
+func mkdirAllCopiedSecrets(dir string, mode os.FileMode) error {
+	dir = filepath.Clean(dir)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := mkdirAllCopiedSecrets(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, mode); err != nil {
+		return err
+	}
+	copiedSecretsPaths = append(copiedSecretsPaths, dir)
+	return nil
+}
+
+//
+// Remove the copies of the secrets files, and the directories created for them, when dockerfy exits
+//
+func removeCopiedSecrets() {
+	fileSysCreateMutex.Lock()
+	defer fileSysCreateMutex.Unlock()
+	for i := len(copiedSecretsPaths) - 1; i >= 0; i-- {
+		if err := os.Remove(copiedSecretsPaths[i]); err != nil && !os.IsNotExist(err) {
+			log.Printf("unable to remove %s: %s", copiedSecretsPaths[i], err)
+		}
+	}
+	copiedSecretsPaths = nil
+}
+
+//
+// Every exit once commands may have been given copies of secrets goes through here, so the copies are
+// always removed
+//
+func exitAndCleanUp(code int) {
+	removeCopiedSecrets()
+	os.Exit(code)
+}
+
+func fatalAndCleanUp(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	exitAndCleanUp(1)
+}
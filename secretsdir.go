@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/fsnotify.v1"
+)
+
+//
+// --secrets-dir directories are watched once the commands are running.  Kubernetes updates a secret
+// volume by swapping its ..data symlink, and when that (or any other change) settles, the secrets are
+// read again and every --template and --template-inline is rendered again, so commands that re-read
+// their config files see the new secrets.  Errors are logged, and the previous secrets are kept.
+// Arguments, --secret-env variables, --secret-file files and the copies of secrets files that commands
+// were given keep the secrets they started with
+//
+
+// wait for a burst of changes, such as an update of several secrets, to finish
+const secretsDirSettleTime = time.Second
+
+func watchSecretsDirs(ctx context.Context) {
+	defer wg.Done()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("unable to watch the --secrets-dir directories: %s", err)
+		return
+	}
+	defer watcher.Close()
+
+	for _, source := range getSecretsSources() {
+		if !strings.HasPrefix(source, "dir://") {
+			continue
+		}
+		dir := strings.TrimPrefix(source, "dir://")
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("unable to watch --secrets-dir %s: %s", dir, err)
+		} else if verboseFlag {
+			log.Printf("Watching --secrets-dir %s", dir)
+		}
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-watcher.Events:
+			if debugFlag {
+				log.Printf("--secrets-dir: %s", event)
+			}
+			settled = time.After(secretsDirSettleTime)
+		case err := <-watcher.Errors:
+			log.Printf("error watching the --secrets-dir directories: %s", err)
+		case <-settled:
+			settled = nil
+			reloadSecretsDirs()
+		}
+	}
+}
+
+//
+// Read the secrets again and render the templates with them.  dockerfy keeps running after any error,
+// since the commands are already running, and keeps the previous secrets
+//
+func reloadSecretsDirs() {
+	if verboseFlag {
+		log.Printf("--secrets-dir changed, rendering the templates again")
+	}
+	next := &TemplateContext{dataFrom: currentTemplateContext()}
+	if err := next.tryLoadSecrets(); err != nil {
+		log.Printf("%s. Keeping the previous secrets", err)
+		return
+	}
+
+	previous := swapTemplateContext(next)
+	err := generateTemplates()
+	if err != nil {
+		log.Println(err)
+	}
+	if logTemplateErrors() || err != nil {
+		swapTemplateContext(previous)
+		log.Printf("some templates were not rendered again after --secrets-dir changed. Keeping the previous secrets")
+	}
+}
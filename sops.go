@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//
+// SOPS (https://github.com/getsops/sops) YAML and JSON secrets files encrypted with age keys.  Each value
+// is encrypted with AES-256-GCM under a data key, which is itself encrypted with age for each recipient:
+//
+//   PROXY_PASSWORD: ENC[AES256_GCM,data:...,iv:...,tag:...,type:str]
+//   sops:
+//     age:
+//       - recipient: age1...
+//         enc: |
+//           -----BEGIN AGE ENCRYPTED FILE-----
+//           ...
+//     mac: ENC[AES256_GCM,data:...]
+//
+// Values are decrypted in memory with the identities described in age.go.  Each value is authenticated
+// together with its key, and the file-wide MAC (a SHA-512 of the values in order) is checked, so values
+// cannot be removed, reordered or added in plaintext.  Only the values that the unencrypted_suffix,
+// encrypted_suffix, unencrypted_regex or encrypted_regex metadata leave unencrypted may be plaintext
+//
+
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	LastModified      string `yaml:"lastmodified"`
+	MAC               string `yaml:"mac"`
+	MACOnlyEncrypted  bool   `yaml:"mac_only_encrypted"`
+	UnencryptedSuffix string `yaml:"unencrypted_suffix"`
+	EncryptedSuffix   string `yaml:"encrypted_suffix"`
+	UnencryptedRegex  string `yaml:"unencrypted_regex"`
+	EncryptedRegex    string `yaml:"encrypted_regex"`
+}
+
+//
+// The state of decrypting one SOPS file
+//
+type sopsTree struct {
+	metadata         sopsMetadata
+	dataKey          []byte
+	unencryptedRegex *regexp.Regexp
+	encryptedRegex   *regexp.Regexp
+	mac              hash.Hash
+}
+
+//
+// Is this parsed YAML document a SOPS file
+//
+func isSopsDocument(doc *yaml.Node) bool {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return false
+	}
+	m := doc.Content[0]
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == "sops" {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// SOPS JSON files are read with encoding/json, but into the same tree of nodes as YAML, which keeps the
+// order of the values for the MAC
+//
+func jsonToNode(content []byte) (*yaml.Node, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	node, err := jsonValueNode(decoder)
+	if err != nil {
+		return nil, err
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{node}}, nil
+}
+
+func jsonValueNode(decoder *json.Decoder) (*yaml.Node, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if t == '{' {
+			node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for decoder.More() {
+			if node.Kind == yaml.MappingNode {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+			}
+			value, err := jsonValueNode(decoder)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, value)
+		}
+		// the closing } or ]
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: t}, nil
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(t.String(), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: t.String()}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(t)}, nil
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+}
+
+//
+// Decrypt a SOPS document, returning its values without the sops metadata
+//
+func sopsDecrypt(doc *yaml.Node) (map[string]interface{}, error) {
+	m := doc.Content[0]
+	tree := &sopsTree{mac: sha512.New()}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == "sops" {
+			if err := m.Content[i+1].Decode(&tree.metadata); err != nil {
+				return nil, fmt.Errorf("bad sops metadata: %s", err)
+			}
+		}
+	}
+	metadata := &tree.metadata
+	if len(metadata.Age) == 0 {
+		return nil, fmt.Errorf("no age recipients in the sops metadata. Only age keys are supported")
+	}
+	if metadata.MAC == "" {
+		return nil, fmt.Errorf("no mac in the sops metadata")
+	}
+	if metadata.UnencryptedSuffix == "" && metadata.EncryptedSuffix == "" &&
+		metadata.UnencryptedRegex == "" && metadata.EncryptedRegex == "" {
+		metadata.UnencryptedSuffix = "_unencrypted"
+	}
+	var err error
+	if metadata.UnencryptedRegex != "" {
+		if tree.unencryptedRegex, err = regexp.Compile(metadata.UnencryptedRegex); err != nil {
+			return nil, fmt.Errorf("bad sops unencrypted_regex: %s", err)
+		}
+	}
+	if metadata.EncryptedRegex != "" {
+		if tree.encryptedRegex, err = regexp.Compile(metadata.EncryptedRegex); err != nil {
+			return nil, fmt.Errorf("bad sops encrypted_regex: %s", err)
+		}
+	}
+
+	var lastErr error
+	for _, recipient := range metadata.Age {
+		key, err := ageDecrypt([]byte(recipient.Enc))
+		if err == nil {
+			tree.dataKey = key
+			break
+		}
+		lastErr = err
+	}
+	if tree.dataKey == nil {
+		return nil, fmt.Errorf("unable to decrypt the sops data key: %s", lastErr)
+	}
+
+	tree.addComments(nil, doc.HeadComment, doc.LineComment, m.HeadComment, m.LineComment)
+	result := make(map[string]interface{})
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key := m.Content[i].Value
+		if key == "sops" {
+			continue
+		}
+		value, err := tree.decryptItem(m.Content[i], m.Content[i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = value
+	}
+	tree.addComments(nil, m.FootComment, doc.FootComment)
+
+	if err := tree.checkMAC(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//
+// Decrypt a mapping's key and value, in the order SOPS adds the key's comments to the MAC
+//
+func (t *sopsTree) decryptItem(keyNode, valueNode *yaml.Node, path []string) (interface{}, error) {
+	t.addComments(path, keyNode.HeadComment, keyNode.LineComment)
+	scalar := valueNode.Kind != yaml.MappingNode && valueNode.Kind != yaml.SequenceNode
+	if scalar {
+		t.addComments(path, valueNode.HeadComment, valueNode.LineComment)
+	}
+	value, err := t.decryptNode(valueNode, append(path[:len(path):len(path)], keyNode.Value))
+	if err != nil {
+		return nil, err
+	}
+	if scalar {
+		t.addComments(path, valueNode.FootComment)
+	}
+	t.addComments(path, keyNode.FootComment)
+	return value, nil
+}
+
+//
+// Decrypt a value and everything under it.  The path of mapping keys to each value is authenticated with it
+//
+func (t *sopsTree) decryptNode(node *yaml.Node, path []string) (interface{}, error) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		t.addComments(path, node.HeadComment, node.LineComment)
+		result := make(map[string]interface{})
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			value, err := t.decryptItem(node.Content[i], node.Content[i+1], path)
+			if err != nil {
+				return nil, err
+			}
+			result[node.Content[i].Value] = value
+		}
+		t.addComments(path, node.FootComment)
+		return result, nil
+	case yaml.SequenceNode:
+		t.addComments(path, node.HeadComment, node.LineComment)
+		result := make([]interface{}, len(node.Content))
+		for i, item := range node.Content {
+			t.addComments(path, item.HeadComment, item.LineComment)
+			value, err := t.decryptNode(item, path)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = value
+			t.addComments(path, item.FootComment)
+		}
+		return result, nil
+	case yaml.ScalarNode:
+		encrypted := t.encrypted(path)
+		if !encrypted {
+			var value interface{}
+			if err := node.Decode(&value); err != nil {
+				return nil, err
+			}
+			t.addToMAC(sopsBytes(value), false)
+			return value, nil
+		}
+		if !strings.HasPrefix(node.Value, "ENC[") {
+			return nil, fmt.Errorf("%s: not encrypted, but the sops metadata says it should be", strings.Join(path, "."))
+		}
+		value, err := sopsDecryptValue(node.Value, t.dataKey, strings.Join(path, ":")+":")
+		if err != nil {
+			return nil, err
+		}
+		t.addToMAC(value, true)
+		return value, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported sops value", strings.Join(path, "."))
+}
+
+//
+// Is the value at this path encrypted, according to the sops metadata
+//
+func (t *sopsTree) encrypted(path []string) bool {
+	encrypted := true
+	if suffix := t.metadata.UnencryptedSuffix; suffix != "" {
+		for _, key := range path {
+			if strings.HasSuffix(key, suffix) {
+				encrypted = false
+				break
+			}
+		}
+	}
+	if suffix := t.metadata.EncryptedSuffix; suffix != "" {
+		encrypted = false
+		for _, key := range path {
+			if strings.HasSuffix(key, suffix) {
+				encrypted = true
+				break
+			}
+		}
+	}
+	if t.unencryptedRegex != nil {
+		for _, key := range path {
+			if t.unencryptedRegex.MatchString(key) {
+				encrypted = false
+				break
+			}
+		}
+	}
+	if t.encryptedRegex != nil {
+		encrypted = false
+		for _, key := range path {
+			if t.encryptedRegex.MatchString(key) {
+				encrypted = true
+				break
+			}
+		}
+	}
+	return encrypted
+}
+
+//
+// SOPS keeps YAML comments, one per line, and includes them in the MAC.  Encrypted comments are decrypted
+// for the MAC but otherwise ignored
+//
+func (t *sopsTree) addComments(path []string, comments ...string) {
+	for _, comment := range comments {
+		for _, line := range strings.Split(comment, "\n") {
+			if line == "" {
+				continue
+			}
+			line = strings.TrimPrefix(line, "#")
+			encrypted := t.encrypted(path) && sopsValue.MatchString(line)
+			if encrypted {
+				if value, err := sopsDecryptValue(line, t.dataKey, strings.Join(path, ":")+":"); err == nil {
+					line = value
+				}
+			}
+			t.addToMAC(line, encrypted)
+		}
+	}
+}
+
+func (t *sopsTree) addToMAC(value string, encrypted bool) {
+	if encrypted || !t.metadata.MACOnlyEncrypted {
+		t.mac.Write([]byte(value))
+	}
+}
+
+func (t *sopsTree) checkMAC() error {
+	mac, err := sopsDecryptValue(t.metadata.MAC, t.dataKey, t.metadata.LastModified)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt the sops mac: %s", err)
+	}
+	if mac != fmt.Sprintf("%X", t.mac.Sum(nil)) {
+		return fmt.Errorf("the sops mac does not match. The file has been changed since it was encrypted")
+	}
+	return nil
+}
+
+//
+// An unencrypted value the way SOPS adds it to the MAC
+//
+func sopsBytes(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+func sopsDecryptValue(value string, dataKey []byte, additionalData string) (string, error) {
+	key := strings.TrimSuffix(strings.Replace(additionalData, ":", ".", -1), ".")
+	m := sopsValue.FindStringSubmatch(value)
+	if m == nil {
+		return "", fmt.Errorf("%s: bad sops value", key)
+	}
+	data, err1 := base64.StdEncoding.DecodeString(m[1])
+	iv, err2 := base64.StdEncoding.DecodeString(m[2])
+	tag, err3 := base64.StdEncoding.DecodeString(m[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(iv) == 0 {
+		return "", fmt.Errorf("%s: bad sops value", key)
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", fmt.Errorf("%s: unable to decrypt: %s", key, err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//
+// A template can write several files from one render, so the number of generated files can be
+// driven by .Env or .Data.  Everything after a {{ file "name" }} marker, up to the next marker, is
+// written to that file.  e.g.
+//
+//   --template '/app/sites.tmpl:/etc/nginx/sites/'
+//
+//   {{ range $name, $site := .Data.sites }}
+//   {{ file (print $name ".conf") }}
+//   server { server_name {{ $site.host }}; }
+//   {{ end }}
+//
+// Relative names are relative to the destination directory, which is the destination itself if it
+// ends with / or is a directory, and otherwise the directory of the destination.  The files written by
+// each template are recorded in a manifest in the destination directory, and files from the previous
+// render that were not written this time are removed, even if a template for a directory writes no files
+//
+
+// NUL bytes do not appear in config files, so the marker cannot be confused with real content
+const fileMarker = "\x00dockerfy-file\x00"
+
+//
+// file template function: start a new output file
+//
+func file(name string) (string, error) {
+	if name == "" || strings.Contains(name, "\x00") {
+		return "", fmt.Errorf("file: bad file name '%s'", name)
+	}
+	return fileMarker + name + "\x00", nil
+}
+
+type renderedFile struct {
+	path    string
+	content []byte
+}
+
+//
+// Split rendered output at the file markers.  head is the output before the first marker.
+// The white space left on the line of a marker is dropped, so markers can sit on lines of their own
+//
+func splitRenderedFiles(content []byte) (head []byte, files []renderedFile, err error) {
+	parts := bytes.Split(content, []byte(fileMarker))
+	head = parts[0]
+	for _, part := range parts[1:] {
+		end := bytes.IndexByte(part, 0)
+		if end < 0 {
+			return nil, nil, fmt.Errorf("bad file marker")
+		}
+		name, body := string(part[:end]), part[end+1:]
+		if nl := bytes.IndexByte(body, '\n'); nl >= 0 && len(bytes.TrimSpace(body[:nl])) == 0 {
+			body = body[nl+1:]
+		}
+		files = append(files, renderedFile{path: name, content: body})
+	}
+	return head, files, nil
+}
+
+//
+// Write rendered output to destPath, or to the files named by its file markers
+//
+func writeRenderedFiles(source string, content []byte, destPath string, options templateOptions) error {
+	head, files, err := splitRenderedFiles(content)
+	if err != nil {
+		return fmt.Errorf("%s: %s", source, err)
+	}
+	fi, err := os.Stat(destPath)
+	toDir := destPath != "" && (strings.HasSuffix(destPath, "/") || (err == nil && fi.IsDir()))
+	if len(files) == 0 && !toDir {
+		return writeGeneratedFile(source, content, destPath, options)
+	}
+	if destPath == "" {
+		return fmt.Errorf("%s uses the file template function, so it needs a destination directory", source)
+	}
+
+	dir := destPath
+	if !toDir {
+		dir = filepath.Dir(destPath)
+		if len(bytes.TrimSpace(head)) > 0 {
+			if err := writeGeneratedFile(source, head, destPath, options); err != nil {
+				return err
+			}
+		}
+	}
+
+	written := make(map[string]bool)
+	for _, f := range files {
+		path := f.path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		path = filepath.Clean(path)
+		if written[path] {
+			return fmt.Errorf("%s writes %s more than once", source, path)
+		}
+		written[path] = true
+		if err := writeGeneratedFile(source, f.content, path, options); err != nil {
+			return err
+		}
+	}
+	return removeStaleFiles(source, dir, written)
+}
+
+//
+// The manifest of the files written by source into dir
+//
+func manifestPath(source, dir string) string {
+	sum := sha1.Sum([]byte(source))
+	return filepath.Join(dir, ".dockerfy-files-"+hex.EncodeToString(sum[:4]))
+}
+
+//
+// Remove the files listed in the manifest from the previous render that were not written this time,
+// and record the files that were
+//
+func removeStaleFiles(source, dir string, written map[string]bool) error {
+	manifest := manifestPath(source, dir)
+	if previous, err := ioutil.ReadFile(manifest); err == nil {
+		for _, path := range strings.Split(string(previous), "\n") {
+			if path == "" || written[path] {
+				continue
+			}
+			if _, err := os.Lstat(path); err != nil {
+				continue
+			}
+			if dryRunFlag {
+				dryRunPrintf("remove: %s (no longer rendered by %s)\n", path, source)
+				continue
+			}
+			if verboseFlag {
+				log.Printf("Removing %s, which is no longer rendered by %s\n", path, source)
+			}
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("unable to remove %s: %s", path, err)
+			}
+		}
+	}
+	if dryRunFlag {
+		return nil
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) && len(written) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(written))
+	for path := range written {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if err := ioutil.WriteFile(manifest, []byte(strings.Join(paths, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %s", manifest, err)
+	}
+	return nil
+}
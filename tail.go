@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 
@@ -20,6 +21,13 @@ func tailFile(ctx context.Context, cancel context.CancelFunc, fileName string, p
 	}
 	_file.Close()
 
+	var out io.Writer = dest
+	if redactSecretsFlag {
+		w := newRedactWriter(dest)
+		defer w.Close()
+		out = w
+	}
+
 	t, err := tail.TailFile(fileName, tail.Config{
 		Follow: true,
 		ReOpen: true,
@@ -41,7 +49,7 @@ func tailFile(ctx context.Context, cancel context.CancelFunc, fileName string, p
 		// get the next log line and echo it out
 		case line := <-t.Lines:
 			if line != nil {
-				fmt.Fprintln(dest, line.Text)
+				fmt.Fprintln(out, line.Text)
 			}
 		}
 	}
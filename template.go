@@ -3,18 +3,79 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"text/template"
+	"time"
 )
 
+//
+// The env, secrets and data seen by templates.  Each is loaded the first time a template uses it, and is
+// then shared by every template until reloadTemplateContext, so secrets files are read once and cannot
+// change half way through startup
+//
 type TemplateContext struct {
-	env, secrets map[string]string
+	envOnce, secretsOnce, dataOnce sync.Once
+	env, secrets                   map[string]string
+	secretsFileNames               []string
+	secretsFileKeys                map[string][]string
+	secretsEncrypted               bool
+	secretTree                     map[string]interface{}
+	data                           map[string]interface{}
+
+	// the names of secrets and data files are evaluated with only .Env, since they are needed to load the rest
+	envOnly bool
+
+	// the secrets of a command with a --secrets-scope are only those of the snapshot that are in scope
+	scope *secretsScope
+
+	// a snapshot reloaded for new --secrets-dir secrets shares the data of the one it replaces
+	dataFrom *TemplateContext
+}
+
+var (
+	templateContext      *TemplateContext
+	templateContextMutex sync.Mutex
+)
+
+//
+// The snapshot of env, secrets and data shared by all the templates
+//
+func currentTemplateContext() *TemplateContext {
+	templateContextMutex.Lock()
+	defer templateContextMutex.Unlock()
+	if templateContext == nil {
+		templateContext = &TemplateContext{}
+	}
+	return templateContext
+}
+
+//
+// Discard the snapshot, so the next template re-reads the environment, secrets and data files
+//
+func reloadTemplateContext() {
+	templateContextMutex.Lock()
+	defer templateContextMutex.Unlock()
+	templateContext = nil
+}
+
+//
+// Replace the snapshot, returning the one it replaces
+//
+func swapTemplateContext(c *TemplateContext) *TemplateContext {
+	templateContextMutex.Lock()
+	defer templateContextMutex.Unlock()
+	previous := templateContext
+	templateContext = c
+	return previous
 }
 
 func GetEnvMap() map[string]string {
@@ -32,31 +93,181 @@ func GetEnvMap() map[string]string {
 // '{{concat "P" "WD" | getenv}}' will print $PWD
 //
 func GetEnv(v string) string {
-    return GetEnvMap()[v]
+	return currentTemplateContext().Env()[v]
+}
+
+//
+// envPrefix template function
+//
+// '{{ range $name, $value := envPrefix "UPSTREAM_" }}' ranges over all the environment variables
+// whose names start with UPSTREAM_, in sorted order
+//
+func envPrefix(prefix string) map[string]string {
+	vars := make(map[string]string)
+	for name, value := range currentTemplateContext().Env() {
+		if strings.HasPrefix(name, prefix) {
+			vars[name] = value
+		}
+	}
+	return vars
+}
+
+//
+// envList template function
+//
+// '{{ range envList "UPSTREAM" }}' ranges over the values of $UPSTREAM_0, $UPSTREAM_1, ... $UPSTREAM_N,
+// stopping at the first variable that is not set.  Lists may start at either _0 or _1
+//
+func envList(name string) []string {
+	env := currentTemplateContext().Env()
+	values := []string{}
+	i := 0
+	if _, ok := env[name+"_0"]; !ok {
+		i = 1
+	}
+	for ; ; i++ {
+		value, ok := env[name+"_"+strconv.Itoa(i)]
+		if !ok {
+			break
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+//
+// Export the NAME=VALUE lines of an --env-file into our environment
+//
+func loadEnvFile(fileName string) error {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	vars, err := readEnvFile(content)
+	if err != nil {
+		return err
+	}
+	for key, value := range vars {
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //
 // .Env.VAR lookup from template context
 //
 func (c *TemplateContext) Env() map[string]string {
-	if c.env != nil {
-		return c.env
+	if c.envOnly || c.scope != nil {
+		return currentTemplateContext().Env()
 	}
-	c.env = GetEnvMap()
+	c.envOnce.Do(func() {
+		c.env = GetEnvMap()
+	})
 	return c.env
 }
 
 //
 // Make secrets available under .Secret.VARNAME in the TemplateContext
 //
-func (c *TemplateContext) Secret() map[string]string {
-	if c.secrets != nil {
-		return c.secrets
+func (c *TemplateContext) Secret() (map[string]string, error) {
+	if c.envOnly {
+		return nil, fmt.Errorf(".Secret is not available in the names of secrets and data files")
+	}
+	return c.secretsMap(), nil
+}
+
+//
+// The secrets as nested documents, for ranging over: {{ range $name, $db := .SecretTree.databases }}
+//
+func (c *TemplateContext) SecretTree() (map[string]interface{}, error) {
+	if c.envOnly {
+		return nil, fmt.Errorf(".SecretTree is not available in the names of secrets and data files")
+	}
+	c.loadSecrets()
+	return c.secretTree, nil
+}
+
+func (c *TemplateContext) loadSecrets() {
+	c.secretsOnce.Do(func() {
+		if c.scope != nil {
+			c.loadScopedSecrets(currentTemplateContext())
+			return
+		}
+		if err := c.readSecrets(); err != nil {
+			fatalAndCleanUp("%s", err)
+		}
+	})
+}
+
+//
+// Load the secrets of a new snapshot, returning any error, so a reload can keep the snapshot it has
+//
+func (c *TemplateContext) tryLoadSecrets() (err error) {
+	c.secretsOnce.Do(func() {
+		err = c.readSecrets()
+	})
+	return err
+}
+
+func (c *TemplateContext) readSecrets() (err error) {
+	sources := getSecretsSources()
+	c.secrets, c.secretTree, c.secretsEncrypted, c.secretsFileKeys, err = getSecrets(sources)
+	if err != nil {
+		return err
+	}
+	addRedactedSecrets(c.secrets)
+	for _, source := range sources {
+		if isSecretsFile(source) {
+			c.secretsFileNames = append(c.secretsFileNames, source)
+		}
 	}
-	c.secrets = getSecrets()
+	return nil
+}
+
+func (c *TemplateContext) secretsMap() map[string]string {
+	c.loadSecrets()
 	return c.secrets
 }
 
+//
+// Were any of the secrets decrypted in memory
+//
+func (c *TemplateContext) secretsAreEncrypted() bool {
+	c.loadSecrets()
+	return c.secretsEncrypted
+}
+
+//
+// The evaluated names of the secrets files
+//
+func (c *TemplateContext) secretsFiles() []string {
+	c.loadSecrets()
+	return c.secretsFileNames
+}
+
+//
+// Make the --data documents available under .Data.NAME in the TemplateContext
+//
+func (c *TemplateContext) Data() (map[string]interface{}, error) {
+	if c.envOnly {
+		return nil, fmt.Errorf(".Data is not available in the names of secrets and data files")
+	}
+	if c.scope != nil {
+		return currentTemplateContext().Data()
+	}
+	c.dataOnce.Do(func() {
+		if c.dataFrom != nil {
+			c.data, _ = c.dataFrom.Data()
+			return
+		}
+		c.data = getData()
+	})
+	return c.data, nil
+}
+
 func exists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -121,21 +332,23 @@ func concat(args ...string) (s string) {
     return
 }
 
-func sequence(firstS, lastS string) []string {
-    // return a sequence of strings from first to last (inclusive)
-    // `sequence 3 5` returns ["3", "4", "5"]
-    first, _ := strconv.Atoi(firstS)
-    last, _ := strconv.Atoi(lastS)
-
-    if last < first {
-        last, first = 0, 0
-    }
-    sequence := make([]string, (last - first + 1))
+func sequence(firstS, lastS string) ([]string, error) {
+	// return a sequence of strings from first to last (inclusive)
+	// `sequence 3 5` returns ["3", "4", "5"], `sequence 5 3` returns []
+	first, err := strconv.Atoi(strings.TrimSpace(firstS))
+	if err != nil {
+		return nil, fmt.Errorf("sequence: first value '%s' is not an integer", firstS)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(lastS))
+	if err != nil {
+		return nil, fmt.Errorf("sequence: last value '%s' is not an integer", lastS)
+	}
 
-    for i := 0; i + first <= last; i++ {
-        sequence[i] = strconv.Itoa(i + first)
-    }
-    return sequence
+	sequence := []string{}
+	for i := first; i <= last; i++ {
+		sequence = append(sequence, strconv.Itoa(i))
+	}
+	return sequence, nil
 }
 
 var funcMap = template.FuncMap{
@@ -151,69 +364,445 @@ var funcMap = template.FuncMap{
         "sequence": sequence,
         "N":        sequence,
         "getenv":   GetEnv,
+        "envPrefix": envPrefix,
+        "envList":   envList,
+
+        "fromJson":     fromJson,
+        "toJson":       toJson,
+        "toPrettyJson": toPrettyJson,
+        "fromYaml":     fromYaml,
+        "toYaml":       toYaml,
+        "fromToml":     fromToml,
+        "toToml":       toToml,
+        "indent":       indent,
+        "nindent":      nindent,
+        "quote":        quote,
+        "squote":       squote,
+
+        "b64enc":    b64enc,
+        "b64dec":    b64dec,
+        "sha256sum": sha256sum,
+        "sha1sum":   sha1sum,
+        "hmac":      hmacSha256,
+        "bcrypt":    bcryptHash,
+        "htpasswd":  htpasswd,
+
+        "hostname":       hostname,
+        "interfaceIP":    interfaceIP,
+        "lookupIP":       lookupIP,
+        "lookupSRV":      lookupSRV,
+        "defaultGateway": defaultGateway,
+        "resolvers":      resolvers,
+
+        "cpuQuota":      cpuQuota,
+        "memoryLimit":   memoryLimit,
+        "memoryLimitMB": memoryLimitMB,
+        "pidsLimit":     pidsLimit,
+
+        "regexMatch":   regexMatch,
+        "regexFind":    regexFind,
+        "regexReplace": regexReplace,
+        "sub":          sub,
+        "mul":          mul,
+        "div":          div,
+        "mod":          mod,
+        "max":          maxInt,
+        "min":          minInt,
+        "join":         join,
+        "trim":         strings.TrimSpace,
+        "trimAll":      strings.Trim,
+        "trimPrefix":   strings.TrimPrefix,
+        "trimSuffix":   strings.TrimSuffix,
+        "upper":        strings.ToUpper,
+        "lower":        strings.ToLower,
+        "hasPrefix":    strings.HasPrefix,
+        "hasSuffix":    strings.HasSuffix,
+        "keys":         keys,
+        "sortedKeys":   sortedKeys,
+        "first":        first,
+        "last":         last,
+        "uniq":         uniq,
+        "now":          time.Now,
+        "dateFormat":   dateFormat,
+
+        "readFile":     readFile,
+        "readFileTrim": readFileTrim,
+        "glob":         glob,
+        "listDir":      listDir,
+        "fileMode":     fileMode,
+        "file":         file,
+
+        "secretFile": secretFile,
     }
 //
 // Execute the string_template under the TemplateContext, and
-// return the result as a string
+// return the result as a string.  source names the argument, such as --wait[2], in error messages.
+// Errors are recorded for reportTemplateErrors, and the result is ""
 //
-func string_template_eval(string_template string) string {
-	var result bytes.Buffer
-    t := template.New("String Template").Funcs(funcMap)
+func string_template_eval(source, string_template string) string {
+	return evalTemplateIn(currentTemplateContext(), source, string_template)
+}
 
+//
+// Evaluate the name of a secrets or data file, which may only use .Env
+//
+func file_name_template_eval(source, string_template string) string {
+	return evalTemplateIn(&TemplateContext{envOnly: true}, source, string_template)
+}
 
-	t, err := t.Parse(string_template)
+func evalTemplateIn(context *TemplateContext, source, string_template string) string {
+	result, err := renderTemplateString(context, source, string_template)
 	if err != nil {
-		log.Fatalf("unable to parse template: %s", err)
+		addTemplateError(source, string_template, err)
+		return ""
 	}
+	if bytes.Contains(result, []byte(fileMarker)) {
+		addTemplateError(source, string_template, fmt.Errorf("the file function can only be used in --template and --template-inline"))
+		return ""
+	}
+	return string(result)
+}
+
+//
+// Options for a generated file, from the last :opts part of a template argument
+// e.g. --template '/app/app.conf.tmpl:/etc/app/app.conf:mode=0640,owner=app,group=app,mkdirs,no-overwrite'
+//
+type templateOptions struct {
+	mode        os.FileMode
+	hasMode     bool
+	owner       string
+	group       string
+	mkdirs      bool
+	noOverwrite bool
+	engine      string // "go" or "envsubst"
+	leftDelim   string // delimiters for this template, instead of --delims
+	rightDelim  string
+}
 
-	err = t.Execute(&result, &TemplateContext{})
+func parseTemplateOptions(opts string) (templateOptions, error) {
+	var options templateOptions
+	for _, opt := range strings.Split(opts, ",") {
+		switch opt {
+		case "mkdirs":
+			options.mkdirs = true
+			continue
+		case "no-overwrite":
+			options.noOverwrite = true
+			continue
+		}
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return options, fmt.Errorf("bad template option '%s'. expected mode=0644, owner=user, group=group, mkdirs, no-overwrite, engine=envsubst, ldelim=[[ or rdelim=]]", opt)
+		}
+		switch parts[0] {
+		case "mode":
+			mode, err := strconv.ParseUint(parts[1], 8, 32)
+			if err != nil || mode > 07777 {
+				return options, fmt.Errorf("bad template mode '%s'. expected octal such as 0644", parts[1])
+			}
+			options.mode, options.hasMode = unixFileMode(uint32(mode)), true
+		case "owner":
+			options.owner = parts[1]
+		case "group":
+			options.group = parts[1]
+		case "engine":
+			if parts[1] != "go" && parts[1] != "envsubst" {
+				return options, fmt.Errorf("unknown template engine '%s'. expected go or envsubst", parts[1])
+			}
+			options.engine = parts[1]
+		case "ldelim":
+			options.leftDelim = parts[1]
+		case "rdelim":
+			options.rightDelim = parts[1]
+		default:
+			return options, fmt.Errorf("unknown template option '%s'", parts[0])
+		}
+	}
+	if (options.leftDelim == "") != (options.rightDelim == "") {
+		return options, fmt.Errorf("template options ldelim and rdelim must be used together")
+	}
+	return options, nil
+}
+
+//
+// Split a --template '/template[:/dest[:opts]]' argument
+//
+func parseTemplate(arg string) (templatePath, dest string, options templateOptions, err error) {
+	parts := strings.Split(arg, ":")
+	switch len(parts) {
+	case 3:
+		if options, err = parseTemplateOptions(parts[2]); err != nil {
+			return
+		}
+		fallthrough
+	case 2:
+		dest = parts[1]
+		fallthrough
+	case 1:
+		templatePath = parts[0]
+	default:
+		err = fmt.Errorf("bad template argument: %s. expected \"/template:/dest[:opts]\"", arg)
+	}
+	return
+}
+
+// a final segment such as mkdir or mode=640 is a mistyped option, not a destination
+var inlineOptionLike = regexp.MustCompile(`^[a-z-]+(,[a-z-]+)*$|=`)
+
+//
+// Split a --template-inline 'content:/dest[:opts]' argument from the right, because the content may contain colons
+//
+func parseInlineTemplate(arg string) (content, dest string, options templateOptions, err error) {
+	parts := strings.Split(arg, ":")
+	if len(parts) >= 3 {
+		if opts, optsErr := parseTemplateOptions(parts[len(parts)-1]); optsErr == nil {
+			options = opts
+			parts = parts[:len(parts)-1]
+		} else if inlineOptionLike.MatchString(parts[len(parts)-1]) {
+			err = optsErr
+			return
+		}
+	}
+	if len(parts) < 2 || parts[len(parts)-1] == "" {
+		err = fmt.Errorf("bad template-inline argument: %s. expected \"content:/dest[:opts]\"", arg)
+		return
+	}
+	return strings.Join(parts[:len(parts)-1], ":"), parts[len(parts)-1], options, nil
+}
+
+//
+// Execute the template content under the TemplateContext and return the result.
+// Parse and execution errors are returned as they are, naming the template by source
+//
+func renderTemplateString(context *TemplateContext, source, content string) ([]byte, error) {
+	return renderGoTemplate(newStringTemplate(source), context, content)
+}
+
+//
+// Render a --template or --template-inline with the engine and delimiters chosen by its options.
+// Templates whose names end with .envsubst use the envsubst engine unless engine=go is given
+//
+func renderTemplateWithOptions(context *TemplateContext, source, content string, options templateOptions) ([]byte, error) {
+	if templateEngine(source, options) == "envsubst" {
+		return renderEnvsubst(context, source, content)
+	}
+	return renderGoTemplate(newOptionsTemplate(source, options), context, content)
+}
+
+func templateEngine(source string, options templateOptions) string {
+	if options.engine == "" && strings.HasSuffix(source, ".envsubst") {
+		return "envsubst"
+	}
+	return options.engine
+}
+
+//
+// A Go template with the delimiters from the template's options, or else --delims
+//
+func newOptionsTemplate(source string, options templateOptions) *template.Template {
+	tmpl := newFileTemplate(source)
+	if options.leftDelim != "" {
+		tmpl = tmpl.Delims(options.leftDelim, options.rightDelim)
+	}
+	return tmpl
+}
+
+func renderGoTemplate(tmpl *template.Template, context *TemplateContext, content string) ([]byte, error) {
+	tmpl, err := tmpl.Funcs(template.FuncMap{"secretFile": context.secretFile}).Parse(content)
 	if err != nil {
-		log.Fatalf("template error: %s\n", err)
+		return nil, err
+	}
+	var result bytes.Buffer
+	if err := tmpl.Execute(&result, context); err != nil {
+		return nil, err
 	}
+	return result.Bytes(), nil
+}
 
-	return result.String()
+//
+// Execute the template at templatePath under the TemplateContext and write it to destPath.
+// Template errors are recorded for reportTemplateErrors, and nothing is written
+//
+func generateFile(templatePath, destPath string, options templateOptions) error {
+	content, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return fmt.Errorf("unable to read template %s: %s", templatePath, err)
+	}
+	result, err := renderTemplateWithOptions(currentTemplateContext(), templatePath, string(content), options)
+	if err != nil {
+		addTemplateError(templatePath, string(content), err)
+		return nil
+	}
+	return writeRenderedFiles(templatePath, result, destPath, options)
 }
 
 //
-// Execute the template at templatePath under the TemplateContext and write it to destPath
+// Render every --template and --template-inline.  Template errors are remembered for reportTemplateErrors,
+// and any other error stops the rendering and is returned
 //
-func generateFile(templatePath, destPath string) bool {
-	tmpl := template.New(filepath.Base(templatePath)).Funcs(funcMap)
+func generateTemplates() error {
+	for i, t := range templatesFlag {
+		template, dest, options, err := parseTemplate(t)
+		if err != nil {
+			return err
+		}
+		template, dest = string_template_eval(flagSource("template", i), template), string_template_eval(flagSource("template", i), dest)
+		if template != "" {
+			if err := generateFile(template, dest, options); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, t := range templatesInlineFlag {
+		content, dest, options, err := parseInlineTemplate(t)
+		if err != nil {
+			return err
+		}
+		if err := generateInlineFile(flagSource("template-inline", i), content, string_template_eval(flagSource("template-inline", i), dest), options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Execute an inline template under the TemplateContext and write it to destPath.
+// source names the argument, such as --template-inline[1], in error messages
+//
+func generateInlineFile(source, inline, destPath string, options templateOptions) error {
+	result, err := renderTemplateWithOptions(currentTemplateContext(), source, inline, options)
+	if err != nil {
+		addTemplateError(source, inline, err)
+		return nil
+	}
+	return writeRenderedFiles("inline:"+destPath, result, destPath, options)
+}
+
+//
+// Write the rendered content of a template to destPath (or stdout), and apply the mode and owner options
+//
+func writeGeneratedFile(source string, content []byte, destPath string, options templateOptions) error {
+	if options.noOverwrite && destPath != "" {
+		if _, err := os.Stat(destPath); err == nil {
+			if dryRunFlag {
+				dryRunPrintf("template: %s --> %s (exists, not overwritten)\n", source, destPath)
+			} else if verboseFlag {
+				log.Printf("Template %s --> %s already exists, not overwritten\n", source, destPath)
+			}
+			return nil
+		}
+	}
 
-	if len(delims) > 0 {
-		tmpl = tmpl.Delims(delims[0], delims[1])
+	if dryRunFlag {
+		dryRunTemplate(source, content, destPath)
+		return nil
 	}
-	tmpl, err := tmpl.ParseFiles(templatePath)
+
+	uid, gid, err := templateOwner(options)
 	if err != nil {
-		log.Fatalf("unable to parse template: %s", err)
+		return fmt.Errorf("bad owner for %s: %s", destPath, err)
+	}
+
+	if options.mkdirs && destPath != "" {
+		if err := mkdirs(filepath.Dir(destPath), uid, gid); err != nil {
+			return fmt.Errorf("unable to create directories for %s: %s", destPath, err)
+		}
 	}
 
 	dest := os.Stdout
 	if destPath != "" {
-		dest, err = os.Create(destPath)
+		// The mode and owner are set before any content is written, so the content is never readable by
+		// those the options exclude, even briefly
+		perm := os.FileMode(0666)
+		if options.hasMode {
+			perm = 0600
+		}
+		dest, err = os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
 		if err != nil {
-			log.Fatalf("unable to create %s", err)
+			return fmt.Errorf("unable to create %s", err)
 		}
 		defer dest.Close()
+		// chown clears the setuid and setgid bits, so it goes first
+		if uid != -1 || gid != -1 {
+			if err := dest.Chown(uid, gid); err != nil {
+				return fmt.Errorf("unable to chown %s: %s", destPath, err)
+			}
+		}
+		if options.hasMode {
+			if err := dest.Chmod(options.mode); err != nil {
+				return fmt.Errorf("unable to chmod %s: %s", destPath, err)
+			}
+		}
 		if verboseFlag {
-			log.Printf("Template %s --> %s\n", templatePath, destPath)
+			log.Printf("Template %s --> %s\n", source, destPath)
 		}
 	}
 
-	err = tmpl.ExecuteTemplate(dest, filepath.Base(templatePath), &TemplateContext{})
-	if err != nil {
-		log.Fatalf("template error: %s\n", err)
+	if _, err := dest.Write(content); err != nil {
+		return fmt.Errorf("unable to write %s: %s", destPath, err)
+	}
+	return nil
+}
+
+//
+// os.FileMode keeps the setuid, setgid and sticky bits apart from the permission bits
+//
+func unixFileMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
 	}
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
 
-	if fi, err := os.Stat(destPath); err == nil {
-		if err := dest.Chmod(fi.Mode()); err != nil {
-			log.Fatalf("unable to chmod temp file: %s\n", err)
+//
+// The uid and gid from the owner= and group= options, or -1 for those that should not change.
+// An owner without a group also sets the group to the owner's primary group
+//
+func templateOwner(options templateOptions) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if options.owner != "" {
+		owner, err := lookupUser(options.owner)
+		if err != nil {
+			return uid, gid, err
 		}
-		if err := dest.Chown(int(fi.Sys().(*syscall.Stat_t).Uid), int(fi.Sys().(*syscall.Stat_t).Gid)); err != nil {
-			log.Fatalf("unable to chown temp file: %s\n", err)
+		uid, _ = strconv.Atoi(owner.Uid)
+		gid, _ = strconv.Atoi(owner.Gid)
+	}
+	if options.group != "" {
+		group, err := user.LookupGroupId(options.group)
+		if err != nil {
+			if group, err = user.LookupGroup(options.group); err != nil {
+				return uid, gid, err
+			}
 		}
+		gid, _ = strconv.Atoi(group.Gid)
 	}
-
-	return true
+	return uid, gid, nil
 }
 
+//
+// Create dir and any missing parents, giving the directories that were created to uid and gid
+//
+func mkdirs(dir string, uid, gid int) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := mkdirs(filepath.Dir(dir), uid, gid); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		return os.Chown(dir, uid, gid)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+#!/usr/bin/env python3
+#
+# A tiny stand-in for the Vault HTTP API, for run-vault-secrets-test:
+#   KV v2 at secret/data/myapp, KV v1 at kv/myapp, and AppRole login at auth/approle/login
+#
+# usage: stub.py PORT
+#
+import json
+import sys
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+TOKEN = "test-token"
+SECRETS = {"PROXY_PASSWORD": "from-vault", "DB_PORT": 5432, "ACCOUNT_ID": 9007199254740993}
+
+
+class VaultStub(BaseHTTPRequestHandler):
+    def reply(self, status, body):
+        data = json.dumps(body).encode()
+        self.send_response(status)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(data)))
+        self.end_headers()
+        self.wfile.write(data)
+
+    def do_GET(self):
+        if self.headers.get("X-Vault-Token") != TOKEN:
+            return self.reply(403, {"errors": ["permission denied"]})
+        if self.path == "/v1/secret/data/myapp":
+            return self.reply(200, {"data": {"data": SECRETS, "metadata": {"version": 3}}})
+        if self.path == "/v1/kv/myapp":
+            return self.reply(200, {"data": SECRETS})
+        self.reply(404, {"errors": []})
+
+    def do_POST(self):
+        body = json.loads(self.rfile.read(int(self.headers["Content-Length"])))
+        if self.path == "/v1/auth/approle/login" and body == {"role_id": "test-role", "secret_id": "test-secret"}:
+            return self.reply(200, {"auth": {"client_token": TOKEN}})
+        self.reply(400, {"errors": ["invalid role or secret ID"]})
+
+    def log_message(self, format, *args):
+        pass
+
+
+HTTPServer(("127.0.0.1", int(sys.argv[1])), VaultStub).serve_forever()
@@ -0,0 +1,18 @@
+// +build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+//
+// Is path on a tmpfs, so files written there never reach a disk
+//
+func isTmpfs(path string) bool {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return false
+	}
+	return fs.Type == unix.TMPFS_MAGIC
+}
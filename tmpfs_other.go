@@ -0,0 +1,10 @@
+// +build !linux
+
+package main
+
+//
+// tmpfs cannot be detected on this OS
+//
+func isTmpfs(path string) bool {
+	return false
+}
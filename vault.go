@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+//
+// Secrets from a HashiCorp Vault KV secrets engine.  e.g.
+//
+//   --secrets 'vault://secret/data/myapp?token_file=/run/secrets/vault-token'
+//   --secrets 'vault://secret/data/myapp?role=my-role-id&secret_id_file=/run/secrets/vault-secret-id'
+//
+// The host part of the url is the mount of the secrets engine, and the rest is the path of the secret.
+// Paths with /data/ after the mount are read from KV version 2, and others from version 1, unless
+// kv=1 or kv=2 is given.  Options:
+//
+//   addr=https://vault:8200   the Vault server, instead of $VAULT_ADDR
+//   token_file=/path          read the token from a file, instead of $VAULT_TOKEN or ~/.vault-token
+//   role=ROLE_ID              log in with AppRole, using this role id ...
+//   role_id_file=/path        ... or the role id in this file,
+//   secret_id_file=/path      and the secret id in this file
+//   approle=approle           the mount of the AppRole auth method
+//   namespace=ns              the Vault Enterprise namespace, instead of $VAULT_NAMESPACE
+//   kv=1|2                    the KV version
+//
+
+var vaultClient = &http.Client{Timeout: 30 * time.Second}
+
+type vaultSecretsProvider struct {
+	source       string
+	addr         string
+	mount        string
+	path         string
+	kvVersion    int
+	tokenFile    string
+	roleID       string
+	roleIDFile   string
+	secretIDFile string
+	approle      string
+	namespace    string
+}
+
+func newVaultSecretsProvider(source string) (SecretsProvider, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	p := &vaultSecretsProvider{
+		source:       "vault://" + u.Host + u.Path,
+		addr:         strings.TrimSuffix(q.Get("addr"), "/"),
+		mount:        u.Host,
+		path:         strings.Trim(u.Path, "/"),
+		tokenFile:    q.Get("token_file"),
+		roleID:       q.Get("role"),
+		roleIDFile:   q.Get("role_id_file"),
+		secretIDFile: q.Get("secret_id_file"),
+		approle:      q.Get("approle"),
+		namespace:    q.Get("namespace"),
+	}
+	if p.mount == "" || p.path == "" {
+		return nil, fmt.Errorf("expected vault://mount/path")
+	}
+	if p.addr == "" {
+		p.addr = strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	}
+	if p.addr == "" {
+		return nil, fmt.Errorf("no Vault address: set $VAULT_ADDR or the addr option")
+	}
+	if p.approle == "" {
+		p.approle = "approle"
+	}
+	if p.namespace == "" {
+		p.namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+
+	switch q.Get("kv") {
+	case "1":
+		p.kvVersion = 1
+	case "2":
+		p.kvVersion = 2
+	case "":
+		p.kvVersion = 1
+		if strings.HasPrefix(p.path, "data/") {
+			p.kvVersion = 2
+		}
+	default:
+		return nil, fmt.Errorf("bad kv version '%s'. expected 1 or 2", q.Get("kv"))
+	}
+	if p.kvVersion == 2 && !strings.HasPrefix(p.path, "data/") {
+		p.path = "data/" + p.path
+	}
+	return p, nil
+}
+
+func (p *vaultSecretsProvider) Name() string {
+	return p.source
+}
+
+func (p *vaultSecretsProvider) Secrets() (map[string]interface{}, error) {
+	token, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := p.request("GET", p.mount+"/"+p.path, token, nil, &response); err != nil {
+		return nil, err
+	}
+	data := response.Data
+	if p.kvVersion == 2 {
+		// KV v2 wraps the secret with its metadata
+		data, _ = response.Data["data"].(map[string]interface{})
+	}
+	if data == nil {
+		return nil, fmt.Errorf("no data in %s", p.source)
+	}
+	return data, nil
+}
+
+//
+// The Vault token: logged in with AppRole if a role is given, else from token_file, $VAULT_TOKEN or ~/.vault-token
+//
+func (p *vaultSecretsProvider) token() (string, error) {
+	if p.roleID != "" || p.roleIDFile != "" {
+		return p.appRoleLogin()
+	}
+	if p.tokenFile != "" {
+		return readTokenFile(p.tokenFile)
+	}
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		if token, err := readTokenFile(home + "/.vault-token"); err == nil {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("no Vault token: use the token_file or role option, or set $VAULT_TOKEN")
+}
+
+func (p *vaultSecretsProvider) appRoleLogin() (string, error) {
+	roleID := p.roleID
+	if p.roleIDFile != "" {
+		var err error
+		if roleID, err = readTokenFile(p.roleIDFile); err != nil {
+			return "", err
+		}
+	}
+	login := map[string]string{"role_id": roleID}
+	if p.secretIDFile != "" {
+		secretID, err := readTokenFile(p.secretIDFile)
+		if err != nil {
+			return "", err
+		}
+		login["secret_id"] = secretID
+	}
+
+	var response struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := p.request("POST", "auth/"+p.approle+"/login", "", login, &response); err != nil {
+		return "", fmt.Errorf("AppRole login failed: %s", err)
+	}
+	if response.Auth.ClientToken == "" {
+		return "", fmt.Errorf("AppRole login returned no token")
+	}
+	return response.Auth.ClientToken, nil
+}
+
+//
+// Call the Vault HTTP API at /v1/path, decoding the JSON response into result
+//
+func (p *vaultSecretsProvider) request(method, path, token string, body interface{}, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, p.addr+"/v1/"+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(respBody, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.Join(vaultErr.Errors, "; "))
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	// json.Number keeps integers above 2^53 exact
+	decoder := json.NewDecoder(bytes.NewReader(respBody))
+	decoder.UseNumber()
+	return decoder.Decode(result)
+}
+
+//
+// Read a token or id from a file, without trailing white space
+//
+func readTokenFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -18,14 +18,19 @@ func waitForDependencies() {
 		return
 	}
 
+	hosts := make([]string, len(waitFlag))
+	for i, host := range waitFlag {
+		hosts[i] = string_template_eval(flagSource("wait", i), host)
+	}
+	exitOnTemplateErrors()
+
 	go func() {
-		for _, host := range waitFlag {
-			host = string_template_eval(host)
+		for _, host := range hosts {
 
 			log.Println("Waiting for host:", host)
 			u, err := url.Parse(host)
 			if err != nil {
-				log.Fatalf("bad hostname provided: %s. %s", host, err.Error())
+				fatalAndCleanUp("bad hostname provided: %s. %s", host, err.Error())
 			}
 
 			switch u.Scheme {
@@ -54,7 +59,7 @@ func waitForDependencies() {
 					}
 				}()
 			default:
-				log.Fatalf("invalid host protocol provided: %s. supported protocols are: tcp, tcp4, tcp6, http and https", u.Scheme)
+				fatalAndCleanUp("invalid host protocol provided: %s. supported protocols are: tcp, tcp4, tcp6, http and https", u.Scheme)
 			}
 		}
 		wg.Wait()
@@ -65,7 +70,7 @@ func waitForDependencies() {
 	case <-dependencyChan:
 		break
 	case <-time.After(waitTimeoutFlag):
-		log.Fatalf("Timeout after %s waiting on dependencies to become available: %v", waitTimeoutFlag, waitFlag)
+		fatalAndCleanUp("Timeout after %s waiting on dependencies to become available: %v", waitTimeoutFlag, waitFlag)
 	}
 
 }